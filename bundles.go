@@ -0,0 +1,275 @@
+package hoard
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// How long the files a pattern matched are used before checking its directories again
+const globRecheck = 2 * time.Second
+
+//
+// Files a bundle pattern matched, along with the directories that were walked
+// to find them and when they were last modified
+//
+type globMatch struct {
+	files   []string
+	dirs    map[string]time.Time
+	checked time.Time
+}
+
+//
+// Declare a bundle that templates can load by name with hoard_bundle, made of
+// files in the given order. Members can be glob patterns, and can come from any
+// hoard, but the bundle is served by this one. The name's extension decides its
+// type, which every member has to share.
+//
+func (hh *HoardHandler) DefineBundle(name string, members ...string) error {
+	defer lockStash()()
+
+	if name == "" {
+		return errors.New("hoard: bundle with no name")
+	}
+	if _, ok := hh.bundles[name]; ok {
+		return fmt.Errorf("hoard: bundle %s is already defined", name)
+	}
+	for _, member := range members {
+		if hoardOf(strings.TrimPrefix(member, "!")) == nil {
+			return fmt.Errorf("hoard: bundle %s: %s is not in any hoard", name, member)
+		}
+	}
+
+	// Patterns are expanded again on every load, this only checks what they match now
+	files, err := expandBundle(members)
+	if err != nil {
+		return fmt.Errorf("hoard: bundle %s: %v", name, err)
+	}
+	if len(files) == 0 || len(files) < 2 && !hasGlob(members) {
+		return fmt.Errorf("hoard: bundle %s needs at least 2 files", name)
+	}
+
+	ctype, err := bundleType(files)
+	if err != nil {
+		return fmt.Errorf("hoard: bundle %s: %v", name, err)
+	}
+	if mime.TypeByExtension(path.Ext(name)) != ctype {
+		return fmt.Errorf("hoard: bundle %s is named for a different type than its files, %s", name, mediaType(ctype))
+	}
+
+	// Catch typos now rather than on the first page using the bundle
+	for _, file := range files {
+		fh := hoardOf(file)
+		f, err := fh.Dir.Open(fh.RemovePrefix(file))
+		if err != nil {
+			return fmt.Errorf("hoard: bundle %s: %v", name, err)
+		}
+		f.Close()
+	}
+
+	hh.bundles[name] = append([]string(nil), members...)
+	return nil
+}
+
+//
+// Find the members of a bundle declared with DefineBundle, by its name or its
+// name under a hoard's prefix
+//
+func namedBundle(in string) (*HoardHandler, []string, bool) {
+	for _, hh := range hoards {
+		if members, ok := hh.bundles[in]; ok {
+			return hh, members, true
+		}
+	}
+	if hh := hoardOf(in); hh != nil {
+		if members, ok := hh.bundles[hh.RemovePrefix(in)]; ok {
+			return hh, members, true
+		}
+	}
+	return nil, nil, false
+}
+
+func isGlob(name string) bool {
+	return strings.ContainsAny(name, "*?[")
+}
+
+//
+// Check if any name is a pattern, an exclude is one even without wildcards
+//
+func hasGlob(names []string) bool {
+	for _, name := range names {
+		if isGlob(name) || strings.HasPrefix(name, "!") {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// Match a slash separated name against a pattern, where ** stands for any number
+// of directories and every other segment is matched as by path.Match
+//
+func matchGlob(pattern, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	if len(pattern) == 0 {
+		return len(name) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(name); i++ {
+			if matchSegments(pattern[1:], name[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(name) == 0 {
+		return false
+	}
+	if ok, err := path.Match(pattern[0], name[0]); err != nil || !ok {
+		return false
+	}
+	return matchSegments(pattern[1:], name[1:])
+}
+
+//
+// Every file in the hoard matching a pattern relative to its directory, in
+// lexical order. Matches are kept, and only looked for again once a directory
+// they were found in has changed.
+//
+func (hh *HoardHandler) glob(pattern string) ([]string, error) {
+	if gm, ok := hh.globs[pattern]; ok {
+		if time.Since(gm.checked) < globRecheck {
+			return gm.files, nil
+		}
+		if !hh.dirsModified(gm.dirs) {
+			gm.checked = time.Now()
+			return gm.files, nil
+		}
+	}
+
+	// Only walk below the part of the pattern without wildcards
+	segments := strings.Split(pattern, "/")
+	base := ""
+	for _, seg := range segments[:len(segments)-1] {
+		if isGlob(seg) {
+			break
+		}
+		base = path.Join(base, seg)
+	}
+
+	matches := []string{}
+	dirs := map[string]time.Time{}
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		f, err := hh.Dir.Open("/" + dir)
+		if err != nil {
+			return err
+		}
+		if stat, err := f.Stat(); err == nil {
+			dirs[dir] = stat.ModTime()
+		}
+		infos, err := f.Readdir(-1)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		for _, info := range infos {
+			name := path.Join(dir, info.Name())
+			if info.IsDir() {
+				if err := walk(name); err != nil {
+					return err
+				}
+			} else if matchGlob(pattern, name) {
+				matches = append(matches, name)
+			}
+		}
+		return nil
+	}
+	if err := walk(base); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	sort.Strings(matches)
+	hh.globs[pattern] = &globMatch{files: matches, dirs: dirs, checked: time.Now()}
+	return matches, nil
+}
+
+//
+// Check if files were added to or removed from any of the directories, or if
+// one of them is gone
+//
+func (hh *HoardHandler) dirsModified(dirs map[string]time.Time) bool {
+	for dir, mod := range dirs {
+		f, err := hh.Dir.Open("/" + dir)
+		if err != nil {
+			return true
+		}
+		stat, err := f.Stat()
+		f.Close()
+		if err != nil || !stat.ModTime().Equal(mod) {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// Replace glob patterns in a list of bundle members with the files they match.
+// A pattern starting with ! removes the files it matches from those before it.
+// Files only appear once, where they were first matched.
+//
+func expandBundle(names []string) ([]string, error) {
+	if !hasGlob(names) {
+		return names, nil
+	}
+
+	files := []string{}
+	seen := map[string]bool{}
+	for _, name := range names {
+		if strings.HasPrefix(name, "!") {
+			pattern := name[1:]
+			kept := files[:0]
+			for _, file := range files {
+				if matchGlob(pattern, file) {
+					delete(seen, file)
+				} else {
+					kept = append(kept, file)
+				}
+			}
+			files = kept
+			continue
+		}
+
+		matches := []string{name}
+		if isGlob(name) {
+			hh := hoardOf(name)
+			if hh == nil {
+				return nil, fmt.Errorf("%s is not in any hoard.", name)
+			}
+			found, err := hh.glob(hh.RemovePrefix(name))
+			if err != nil {
+				return nil, err
+			}
+			matches = matches[:0]
+			for _, file := range found {
+				matches = append(matches, hh.Prefix+file)
+			}
+		}
+
+		for _, file := range matches {
+			if !seen[file] {
+				seen[file] = true
+				files = append(files, file)
+			}
+		}
+	}
+	return files, nil
+}
@@ -0,0 +1,80 @@
+package hoard
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"js/*.js", "js/a.js", true},
+		{"js/*.js", "js/a.css", false},
+		{"js/*.js", "js/lib/a.js", false},
+		{"js/?.js", "js/a.js", true},
+		{"js/?.js", "js/ab.js", false},
+		{"js/[ab].js", "js/b.js", true},
+		{"js/[ab].js", "js/c.js", false},
+		{"js/**/*.js", "js/a.js", true},
+		{"js/**/*.js", "js/lib/deep/a.js", true},
+		{"js/**", "js/lib/a.js", true},
+		{"**/*.css", "a.css", true},
+		{"**/*.css", "css/x/a.css", true},
+		{"js/**/vendor/*.js", "js/a/b/vendor/c.js", true},
+		{"js/**/vendor/*.js", "js/a/b/c.js", false},
+		{"js/a.js", "js/a.js", true},
+		{"js/[.js", "js/[.js", false},
+	}
+	for _, tt := range tests {
+		if got := matchGlob(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("matchGlob(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestExpandBundle(t *testing.T) {
+	testHoard(t, "/expand/", map[string]string{
+		"js/a.js":        "a()",
+		"js/b.js":        "b()",
+		"js/b.test.js":   "t()",
+		"js/lib/c.js":    "c()",
+		"js/lib/d.js":    "d()",
+		"js/vendor/e.js": "e()",
+		"css/a.css":      "a{}",
+	})
+
+	tests := []struct {
+		name  string
+		names []string
+		want  []string // Nil if it has to fail
+	}{
+		{"no patterns", []string{"/expand/js/b.js", "/expand/js/a.js"}, []string{"/expand/js/b.js", "/expand/js/a.js"}},
+		{"one directory", []string{"/expand/js/*.js"}, []string{"/expand/js/a.js", "/expand/js/b.js", "/expand/js/b.test.js"}},
+		{"every directory", []string{"/expand/js/**/*.js"}, []string{
+			"/expand/js/a.js", "/expand/js/b.js", "/expand/js/b.test.js", "/expand/js/lib/c.js", "/expand/js/lib/d.js", "/expand/js/vendor/e.js",
+		}},
+		{"file first", []string{"/expand/js/lib/d.js", "/expand/js/lib/*.js"}, []string{"/expand/js/lib/d.js", "/expand/js/lib/c.js"}},
+		{"exclude", []string{"/expand/js/**/*.js", "!/expand/js/**/*.test.js", "!/expand/js/vendor/**"}, []string{
+			"/expand/js/a.js", "/expand/js/b.js", "/expand/js/lib/c.js", "/expand/js/lib/d.js",
+		}},
+		{"exclude then add back", []string{"/expand/js/*.js", "!/expand/js/b*", "/expand/js/b.js"}, []string{"/expand/js/a.js", "/expand/js/b.js"}},
+		{"exclude only what came before", []string{"!/expand/js/a.js", "/expand/js/a.js"}, []string{"/expand/js/a.js"}},
+		{"no matches", []string{"/expand/js/*.ts"}, []string{}},
+		{"missing directory", []string{"/expand/ts/**/*.ts"}, []string{}},
+		{"outside every hoard", []string{"/nowhere/*.js"}, nil},
+	}
+	for _, tt := range tests {
+		got, err := expandBundle(tt.names)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%s: got %v, want an error", tt.name, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v %v, want %v", tt.name, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package hoard
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"strings"
+)
+
+//
+// Keep a gzip compressed copy of the content, unless compressing does not make
+// it any smaller
+//
+func (fb *FileBuffer) compress() {
+	fb.gzipped = nil
+
+	var buf bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return
+	}
+	zw.Write(fb.buf)
+	if err := zw.Close(); err != nil {
+		return
+	}
+	if buf.Len() < len(fb.buf) {
+		fb.gzipped = buf.Bytes()
+	}
+}
+
+//
+// Check if a client takes gzip compressed responses
+//
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params := part, ""
+		if i := strings.Index(part, ";"); i >= 0 {
+			coding, params = part[:i], part[i+1:]
+		}
+		coding = strings.TrimSpace(coding)
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		// An explicit q=0 turns it down
+		params = strings.Replace(params, " ", "", -1)
+		return params != "q=0" && params != "q=0.0" && params != "q=0.00" && params != "q=0.000"
+	}
+	return false
+}
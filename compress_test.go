@@ -0,0 +1,120 @@
+package hoard
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, gzip;q=0.5", true},
+		{"br, *", true},
+		{"gzip;q=0", false},
+		{"gzip; q=0.000", false},
+		{"gzip;q=0, deflate", false},
+		{"identity", false},
+		{"x-gzip", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", tt.header)
+		if got := acceptsGzip(r); got != tt.want {
+			t.Errorf("%q: got %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestBundleEtag(t *testing.T) {
+	hh := testHoard(t, "/etags/", map[string]string{
+		"a.css": strings.Repeat("a{color:red}\n", 50),
+		"b.css": strings.Repeat("b{color:blue}\n", 50),
+		"c.css": "c{}",
+		"d.css": "d{}",
+	})
+	url, fb, err := loadBundle(nil, []string{"/etags/a.css", "/etags/b.css"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fb.gzipped == nil {
+		t.Fatal("repetitive bundle was not compressed")
+	}
+
+	serve := func(header, value string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", url, nil)
+		if header != "" {
+			r.Header.Set(header, value)
+		}
+		rec := httptest.NewRecorder()
+		hh.ServeHTTP(rec, r)
+		return rec
+	}
+
+	plain := serve("", "")
+	etag := plain.Header().Get("Etag")
+	if plain.Code != http.StatusOK || plain.Body.String() != string(fb.buf) {
+		t.Fatalf("plain: got %d %q", plain.Code, plain.Body.String())
+	}
+	if !strings.HasPrefix(etag, `"`) || !strings.HasSuffix(etag, `"`) || !strings.Contains(url, strings.Trim(etag, `"`)) {
+		t.Errorf("plain: Etag %s does not match %s", etag, url)
+	}
+	if got := plain.Header().Get("Vary"); got != "Accept-Encoding" {
+		t.Errorf("plain: Vary %q", got)
+	}
+	if got := plain.Header().Get("Content-Encoding"); got != "" {
+		t.Errorf("plain: Content-Encoding %q", got)
+	}
+
+	zipped := serve("Accept-Encoding", "gzip")
+	gzipEtag := strings.TrimSuffix(etag, `"`) + `-gzip"`
+	if got := zipped.Header().Get("Etag"); got != gzipEtag {
+		t.Errorf("gzip: Etag %s, want %s", got, gzipEtag)
+	}
+	if got := zipped.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Errorf("gzip: Content-Encoding %q", got)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(zipped.Body.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, err := ioutil.ReadAll(zr); err != nil || string(body) != string(fb.buf) {
+		t.Errorf("gzip: body %q, %v", body, err)
+	}
+
+	tests := []struct {
+		name, header, value string
+		code                int
+	}{
+		{"matching", "If-None-Match", etag, http.StatusNotModified},
+		{"any", "If-None-Match", "*", http.StatusNotModified},
+		{"stale", "If-None-Match", `"stale"`, http.StatusOK},
+		{"other encoding", "If-None-Match", gzipEtag, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if rec := serve(tt.header, tt.value); rec.Code != tt.code {
+			t.Errorf("%s: status %d, want %d", tt.name, rec.Code, tt.code)
+		}
+	}
+
+	// Too small to be worth compressing
+	url, fb, err = loadBundle(nil, []string{"/etags/c.css", "/etags/d.css"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", url, nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	hh.ServeHTTP(rec, r)
+	if fb.gzipped != nil || rec.Header().Get("Vary") != "" || rec.Header().Get("Content-Encoding") != "" || rec.Header().Get("Etag") == "" {
+		t.Errorf("small bundle: headers %v", rec.Header())
+	}
+}
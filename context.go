@@ -0,0 +1,160 @@
+package hoard
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"html/template"
+	"sync"
+)
+
+type stateKey struct{}
+
+//
+// Everything hoard keeps track of while a single page renders
+//
+type renderState struct {
+	mu      sync.Mutex
+	nonce   string
+	debug   bool
+	scripts []string      // CSP sources allowing inline scripts emitted by this render
+	styles  []string      // CSP sources allowing inline styles emitted by this render
+	assets  []preloadLink // Files hoard resolved during this render
+
+	required []requirement   // Files asked for with hoard_require
+	token    string          // Marks where hoard_head and hoard_footer output goes
+	bundle   map[string]bool // Types whose required files are bundled
+}
+
+//
+// Get the render state of a context, nil if it has none
+//
+func stateFrom(ctx context.Context) *renderState {
+	if ctx == nil {
+		return nil
+	}
+	st, _ := ctx.Value(stateKey{}).(*renderState)
+	return st
+}
+
+//
+// Get the render state of a context, adding one if it has none
+//
+func withState(ctx context.Context) (context.Context, *renderState) {
+	if st := stateFrom(ctx); st != nil {
+		return ctx, st
+	}
+	st := &renderState{}
+	return context.WithValue(ctx, stateKey{}, st), st
+}
+
+//
+// Attach a fresh random nonce to a context. Every tag emitted by the functions
+// from FuncsContext for it will carry the nonce.
+//
+func WithNonce(ctx context.Context) context.Context {
+	ctx, st := withState(ctx)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.nonce == "" {
+		buf := make([]byte, 16)
+		if _, err := rand.Read(buf); err != nil {
+			panic(err)
+		}
+		st.nonce = base64.StdEncoding.EncodeToString(buf)
+	}
+	return ctx
+}
+
+//
+// Get the nonce attached to a context, empty if there is none
+//
+func Nonce(ctx context.Context) string {
+	st := stateFrom(ctx)
+	if st == nil {
+		return ""
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.nonce
+}
+
+//
+// Template functions for rendering a single request, aware of its nonce
+//
+func FuncsContext(ctx context.Context) template.FuncMap {
+	return funcMap(stateFrom(ctx))
+}
+
+// Latest hash of each inline asset hoard has emitted, by what it was made from, so
+// a CSP without a nonce can allow them before rendering
+var inlineHashes = struct {
+	sync.Mutex
+	scripts map[string]string
+	styles  map[string]string
+}{scripts: map[string]string{}, styles: map[string]string{}}
+
+//
+// Remember the hash of an inline script or style so a CSP can allow it. An asset
+// made from the same thing again replaces the hash it had before.
+//
+func (st *renderState) recordInline(script bool, from, content string) {
+	sum := sha256.Sum256([]byte(content))
+	source := "'sha256-" + base64.StdEncoding.EncodeToString(sum[:]) + "'"
+
+	inlineHashes.Lock()
+	if script {
+		inlineHashes.scripts[from] = source
+	} else {
+		inlineHashes.styles[from] = source
+	}
+	inlineHashes.Unlock()
+
+	if st == nil {
+		return
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if script {
+		st.scripts = append(st.scripts, source)
+	} else {
+		st.styles = append(st.styles, source)
+	}
+}
+
+//
+// The nonce attribute for tags, none if there is no nonce
+//
+func (st *renderState) nonceAttrs() Attrs {
+	if st == nil {
+		return nil
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.nonce == "" {
+		return nil
+	}
+	return Attrs{{Name: "nonce", Value: st.nonce}}
+}
+
+//
+// Mark a context as being debugged, so bundles rendered for it are split into
+// tags for each of their files as they are on disk
+//
+func WithDebug(ctx context.Context) context.Context {
+	ctx, st := withState(ctx)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.debug = true
+	return ctx
+}
+
+func (st *renderState) debugging() bool {
+	if st == nil {
+		return false
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.debug
+}
@@ -0,0 +1,94 @@
+package hoard
+
+import (
+	"context"
+	"sort"
+	"strings"
+)
+
+//
+// Builds a Content-Security-Policy header value
+//
+type CSP struct {
+	order      []string
+	directives map[string][]string
+}
+
+func NewCSP() *CSP {
+	return &CSP{directives: make(map[string][]string)}
+}
+
+//
+// Add sources to a directive, such as Add("script-src", "'self'")
+//
+func (c *CSP) Add(directive string, sources ...string) *CSP {
+	directive = strings.ToLower(directive)
+	existing, ok := c.directives[directive]
+	if !ok {
+		c.order = append(c.order, directive)
+	}
+	for _, source := range sources {
+		found := false
+		for _, e := range existing {
+			if e == source {
+				found = true
+				break
+			}
+		}
+		if !found {
+			existing = append(existing, source)
+		}
+	}
+	c.directives[directive] = existing
+	return c
+}
+
+//
+// Allow everything hoard emits for a request: its nonce, and the hashes of inline
+// scripts and styles rendered for it. Without a nonce the page may not have been
+// rendered yet, so the latest hash of every inline asset is allowed instead.
+//
+func (c *CSP) AddHoard(ctx context.Context) *CSP {
+	var scripts, styles []string
+	if nonce := Nonce(ctx); nonce != "" {
+		c.Add("script-src", "'nonce-"+nonce+"'")
+		c.Add("style-src", "'nonce-"+nonce+"'")
+	} else {
+		inlineHashes.Lock()
+		for _, source := range inlineHashes.scripts {
+			scripts = append(scripts, source)
+		}
+		for _, source := range inlineHashes.styles {
+			styles = append(styles, source)
+		}
+		inlineHashes.Unlock()
+	}
+
+	if st := stateFrom(ctx); st != nil {
+		st.mu.Lock()
+		scripts = append(scripts, st.scripts...)
+		styles = append(styles, st.styles...)
+		st.mu.Unlock()
+	}
+
+	sort.Strings(scripts)
+	sort.Strings(styles)
+	if len(scripts) > 0 {
+		c.Add("script-src", scripts...)
+	}
+	if len(styles) > 0 {
+		c.Add("style-src", styles...)
+	}
+	return c
+}
+
+//
+// The header value
+//
+func (c *CSP) String() string {
+	parts := make([]string, 0, len(c.order))
+	for _, directive := range c.order {
+		parts = append(parts, strings.TrimSpace(directive+" "+strings.Join(c.directives[directive], " ")))
+	}
+	return strings.Join(parts, "; ")
+}
@@ -0,0 +1,513 @@
+package hoard
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"path"
+	"strings"
+)
+
+//
+// Rewrites relative url() references in CSS to the hashed URLs of the assets they point at
+//
+var RewriteCSSURLs Transformer = cssURLRewriter{}
+
+type cssURLRewriter struct{}
+
+func (cssURLRewriter) Transform(tc *TransformContext, src []byte) ([]byte, error) {
+	return replaceCSSURLs(src, func(ref string) string {
+		return tc.resolveURL(ref)
+	}), nil
+}
+
+//
+// Replaces url() references to files in the hoard no bigger than limit bytes with
+// data URIs. Must come before RewriteCSSURLs in the pipeline, which then handles
+// whatever is left.
+//
+func InlineCSSURLs(limit int64) Transformer {
+	return cssURLInliner{limit: limit}
+}
+
+type cssURLInliner struct {
+	limit int64
+}
+
+func (ci cssURLInliner) Transform(tc *TransformContext, src []byte) ([]byte, error) {
+	return replaceCSSURLs(src, func(ref string) string {
+		// Fragments and queries mean nothing inside a data URI
+		if isExternalURL(ref) || strings.ContainsAny(ref, "?#") {
+			return ref
+		}
+		name, ok := tc.resolveName(ref)
+		if !ok || name == "" || mediaType(mime.TypeByExtension(path.Ext(name))) == "text/css" {
+			return ref
+		}
+
+		hashed, err := addResource(name, tc.Hoard)
+		if err != nil {
+			tc.Hoard.reportError(tc.Name, err)
+			return ref
+		}
+		fb := tc.Hoard.Stashed[name]
+		if int64(len(fb.body)) > ci.limit {
+			return ref
+		}
+		tc.AddDependency(name)
+		tc.addLink(tc.Hoard.Prefix+name, hashed)
+		return fb.dataURI()
+	}), nil
+}
+
+//
+// Check if a reference points somewhere hoard cannot follow
+//
+func isExternalURL(ref string) bool {
+	if ref == "" || strings.HasPrefix(ref, "#") || strings.HasPrefix(ref, "//") {
+		return true
+	}
+	// Any scheme, such as data:, http: or https:
+	if i := strings.IndexAny(ref, ":/?#"); i > 0 && ref[i] == ':' {
+		return true
+	}
+	return false
+}
+
+//
+// Split the query string and fragment off a reference
+//
+func splitRef(ref string) (string, string) {
+	if i := strings.IndexAny(ref, "?#"); i >= 0 {
+		return ref[:i], ref[i:]
+	}
+	return ref, ""
+}
+
+//
+// Find the file a reference from the file being transformed points at, relative
+// to this hoard. Returns false if it leaves the hoard directory.
+//
+func (tc *TransformContext) resolveName(ref string) (string, bool) {
+	name := path.Join(path.Dir("/"+tc.Name), ref)
+	if strings.HasPrefix(ref, "/") {
+		if hoardOf(ref) != tc.Hoard {
+			return "", false
+		}
+		name = path.Clean("/" + tc.Hoard.RemovePrefix(ref))
+	}
+	return name[1:], true
+}
+
+//
+// Replace a reference with the hashed URL of what it points at, marking it as a
+// dependency. Hashed files are all served from the top of the hoard, so relative
+// references that cannot be loaded are made absolute to keep pointing at the
+// same place.
+//
+func (tc *TransformContext) resolveURL(ref string) string {
+	if isExternalURL(ref) {
+		return ref
+	}
+
+	file, suffix := splitRef(ref)
+	if strings.HasPrefix(file, "/") && hoardOf(file) != tc.Hoard {
+		// Could belong to another hoard
+		hashed, err := preload(file)
+		if err != nil {
+			tc.Hoard.reportError(tc.Name, err)
+			return ref
+		}
+		if hashed != file {
+			tc.addLink(file, hashed)
+		}
+		return hashed + suffix
+	}
+
+	name, ok := tc.resolveName(file)
+	if !ok || name == "" {
+		return ref
+	}
+
+	hashed, err := addResource(name, tc.Hoard)
+	if err != nil {
+		tc.Hoard.reportError(tc.Name, err)
+		return tc.Hoard.Prefix + name + suffix
+	}
+	tc.AddDependency(name)
+	tc.addLink(tc.Hoard.Prefix+name, hashed)
+	return hashed + suffix
+}
+
+func hasPrefixFold(b []byte, prefix string) bool {
+	return len(b) >= len(prefix) && strings.EqualFold(string(b[:len(prefix)]), prefix)
+}
+
+func isCSSSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+func isCSSNameByte(c byte) bool {
+	return c == '-' || c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
+
+//
+// Find the end of a CSS string starting at i, just past the closing quote
+//
+func skipCSSString(src []byte, i int) int {
+	q := src[i]
+	for i++; i < len(src); i++ {
+		switch src[i] {
+		case '\\':
+			i++
+		case q, '\n':
+			return i + 1
+		}
+	}
+	return len(src)
+}
+
+//
+// Find the end of a CSS comment starting at i
+//
+func skipCSSComment(src []byte, i int) int {
+	if end := bytes.Index(src[i+2:], []byte("*/")); end >= 0 {
+		return i + 2 + end + 2
+	}
+	return len(src)
+}
+
+//
+// Parse the url() token starting at i, returning the reference, its quote
+// character (or 0) and the offset just past it. Returns -1 if it is malformed.
+//
+func parseCSSURL(src []byte, i int) (string, byte, int) {
+	j := i + len("url(")
+	for j < len(src) && isCSSSpace(src[j]) {
+		j++
+	}
+	if j >= len(src) {
+		return "", 0, -1
+	}
+
+	var ref string
+	var quote byte
+	if src[j] == '"' || src[j] == '\'' {
+		quote = src[j]
+		end := skipCSSString(src, j)
+		if end > len(src) || src[end-1] != quote {
+			return "", 0, -1
+		}
+		ref = string(src[j+1 : end-1])
+		j = end
+		for j < len(src) && isCSSSpace(src[j]) {
+			j++
+		}
+		if j >= len(src) || src[j] != ')' {
+			return "", 0, -1
+		}
+	} else {
+		end := bytes.IndexByte(src[j:], ')')
+		if end < 0 {
+			return "", 0, -1
+		}
+		ref = strings.TrimSpace(string(src[j : j+end]))
+		j += end
+	}
+	return ref, quote, j + 1
+}
+
+//
+// Call fn on every url() reference in CSS, replacing it with the result. Strings
+// and comments outside of url() are left alone.
+//
+func replaceCSSURLs(src []byte, fn func(ref string) string) []byte {
+	var out bytes.Buffer
+	last := 0
+	for i := 0; i < len(src); {
+		switch {
+		case src[i] == '/' && i+1 < len(src) && src[i+1] == '*':
+			i = skipCSSComment(src, i)
+		case src[i] == '"' || src[i] == '\'':
+			i = skipCSSString(src, i)
+		case hasPrefixFold(src[i:], "url(") && (i == 0 || !isCSSNameByte(src[i-1])):
+			ref, quote, end := parseCSSURL(src, i)
+			if end < 0 {
+				i += len("url(")
+				continue
+			}
+			if replaced := fn(ref); replaced != ref {
+				out.Write(src[last:i])
+				out.WriteString("url(")
+				if quote != 0 {
+					out.WriteByte(quote)
+				}
+				out.WriteString(replaced)
+				if quote != 0 {
+					out.WriteByte(quote)
+				}
+				out.WriteString(")")
+				last = end
+			}
+			i = end
+		default:
+			i++
+		}
+	}
+
+	if last == 0 {
+		return src
+	}
+	out.Write(src[last:])
+	return out.Bytes()
+}
+
+//
+// Inlines local @import rules, recursively, so a stylesheet is served as a single file
+//
+var InlineCSSImports Transformer = cssImportInliner{}
+
+type cssImportInliner struct{}
+
+func (cssImportInliner) Transform(tc *TransformContext, src []byte) ([]byte, error) {
+	var kept bytes.Buffer
+	out, err := inlineCSSImports(tc, tc.Name, src, []string{tc.Name}, &kept)
+	if err != nil || kept.Len() == 0 {
+		return out, err
+	}
+	return hoistCSSImports(out, kept.Bytes()), nil
+}
+
+//
+// A single @import rule
+//
+type cssImport struct {
+	start, end int    // Span of the whole rule including the semicolon
+	ref        string // What is imported
+	conditions string // Media query, layer or supports conditions
+}
+
+//
+// Find the @import rules at the top level of a stylesheet
+//
+func findCSSImports(src []byte) []cssImport {
+	var imports []cssImport
+	depth := 0
+	for i := 0; i < len(src); {
+		switch c := src[i]; {
+		case c == '/' && i+1 < len(src) && src[i+1] == '*':
+			i = skipCSSComment(src, i)
+		case c == '"' || c == '\'':
+			i = skipCSSString(src, i)
+		case c == '{':
+			depth++
+			i++
+		case c == '}':
+			depth--
+			i++
+		case c == '@' && depth == 0 && hasPrefixFold(src[i:], "@import") &&
+			(i+7 == len(src) || !isCSSNameByte(src[i+7])):
+			imp, ok := parseCSSImport(src, i)
+			if !ok {
+				i += len("@import")
+				continue
+			}
+			imports = append(imports, imp)
+			i = imp.end
+		default:
+			i++
+		}
+	}
+	return imports
+}
+
+func parseCSSImport(src []byte, start int) (cssImport, bool) {
+	imp := cssImport{start: start}
+	j := start + len("@import")
+	for j < len(src) && isCSSSpace(src[j]) {
+		j++
+	}
+	if j >= len(src) {
+		return imp, false
+	}
+
+	switch {
+	case src[j] == '"' || src[j] == '\'':
+		end := skipCSSString(src, j)
+		if end > len(src) || src[end-1] != src[j] {
+			return imp, false
+		}
+		imp.ref = string(src[j+1 : end-1])
+		j = end
+	case hasPrefixFold(src[j:], "url("):
+		ref, _, end := parseCSSURL(src, j)
+		if end < 0 {
+			return imp, false
+		}
+		imp.ref = ref
+		j = end
+	default:
+		return imp, false
+	}
+
+	// Everything up to the semicolon is conditions on the import
+	k := j
+	for k < len(src) && src[k] != ';' {
+		if src[k] == '"' || src[k] == '\'' {
+			k = skipCSSString(src, k)
+			continue
+		}
+		k++
+	}
+	imp.conditions = strings.TrimSpace(string(src[j:k]))
+	if k < len(src) {
+		k++
+	}
+	imp.end = k
+	return imp, true
+}
+
+//
+// Make relative url() references of an imported file absolute, since once it is
+// inlined they would otherwise resolve against the importing file
+//
+func rebaseCSSURLs(hh *HoardHandler, name string, src []byte) []byte {
+	dir := path.Dir("/" + name)
+	return replaceCSSURLs(src, func(ref string) string {
+		if isExternalURL(ref) || strings.HasPrefix(ref, "/") {
+			return ref
+		}
+		return hh.Prefix + path.Join(dir, ref)[1:]
+	})
+}
+
+//
+// Remove @charset rules, only the one at the very start of the output counts
+//
+func stripCSSCharset(src []byte) []byte {
+	src = bytes.TrimPrefix(src, []byte("\xef\xbb\xbf"))
+	if hasPrefixFold(src, "@charset") {
+		if end := bytes.IndexByte(src, ';'); end >= 0 {
+			return src[end+1:]
+		}
+	}
+	return src
+}
+
+//
+// The text of an @import rule that is kept rather than inlined. The stylesheet is
+// served from the top of the hoard, so a relative reference is made absolute.
+//
+func keptCSSImport(hh *HoardHandler, name string, src []byte, imp cssImport) string {
+	file, suffix := splitRef(imp.ref)
+	if isExternalURL(file) || strings.HasPrefix(file, "/") {
+		return string(src[imp.start:imp.end])
+	}
+
+	url := hh.Prefix + path.Join(path.Dir("/"+name), file)[1:] + suffix
+	rule := `@import "` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(url) + `"`
+	if imp.conditions != "" {
+		rule += " " + imp.conditions
+	}
+	return rule + ";"
+}
+
+//
+// Replace every local @import in a stylesheet with the content of the file it
+// names, recursively. Imports that cannot be inlined, such as remote ones or ones
+// with layer or supports conditions, are collected in kept instead, to be moved
+// to the top of the whole stylesheet where they stay valid.
+//
+func inlineCSSImports(tc *TransformContext, name string, src []byte, stack []string, kept *bytes.Buffer) ([]byte, error) {
+	imports := findCSSImports(src)
+	if len(imports) == 0 {
+		return src, nil
+	}
+
+	var out bytes.Buffer
+	last := 0
+	for _, imp := range imports {
+		out.Write(src[last:imp.start])
+		last = imp.end
+
+		rule := keptCSSImport(tc.Hoard, name, src, imp)
+		file, _ := splitRef(imp.ref)
+		cond := strings.ToLower(imp.conditions)
+		if isExternalURL(file) || strings.HasPrefix(cond, "layer") || strings.HasPrefix(cond, "supports") {
+			kept.WriteString(rule + "\n")
+			continue
+		}
+
+		// Resolve against the file doing the importing
+		child, ok := (&TransformContext{Hoard: tc.Hoard, Name: name}).resolveName(file)
+		if !ok {
+			kept.WriteString(rule + "\n")
+			continue
+		}
+
+		for _, s := range stack {
+			if s == child {
+				return nil, fmt.Errorf("@import cycle: %s -> %s", strings.Join(stack, " -> "), child)
+			}
+		}
+
+		f, err := tc.Hoard.Dir.Open(child)
+		if err != nil {
+			return nil, err
+		}
+		content, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		tc.AddDependency(child)
+
+		var childKept bytes.Buffer
+		content, err = inlineCSSImports(tc, child, content, append(stack, child), &childKept)
+		if err != nil {
+			return nil, err
+		}
+
+		// Imports moved to the top would lose the media query, so the browser is
+		// left to load the file itself
+		if imp.conditions != "" && childKept.Len() > 0 {
+			kept.WriteString(rule + "\n")
+			continue
+		}
+		kept.Write(childKept.Bytes())
+
+		content = rebaseCSSURLs(tc.Hoard, child, stripCSSCharset(content))
+		if imp.conditions != "" {
+			fmt.Fprintf(&out, "@media %s {\n%s\n}\n", imp.conditions, content)
+		} else {
+			out.Write(content)
+			out.WriteByte('\n')
+		}
+	}
+	out.Write(src[last:])
+	return out.Bytes(), nil
+}
+
+//
+// Put kept @import rules at the top of a stylesheet, since they have to come
+// before any other rule other than @charset
+//
+func hoistCSSImports(src, kept []byte) []byte {
+	src = bytes.TrimPrefix(src, utf8BOM)
+	var charset []byte
+	if hasPrefixFold(src, "@charset") {
+		if end := bytes.IndexByte(src, ';'); end >= 0 {
+			charset, src = src[:end+1], src[end+1:]
+		}
+	}
+
+	var hoisted bytes.Buffer
+	if charset != nil {
+		hoisted.Write(charset)
+		hoisted.WriteByte('\n')
+	}
+	hoisted.Write(kept)
+	hoisted.Write(src)
+	return hoisted.Bytes()
+}
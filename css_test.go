@@ -0,0 +1,128 @@
+package hoard
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReplaceCSSURLs(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"bare", `a{background:url(img/a.png)}`, `a{background:url(IMG/A.PNG)}`},
+		{"double quoted", `a{background:url("a.png")}`, `a{background:url("A.PNG")}`},
+		{"single quoted", `a{background:url('a b.png')}`, `a{background:url('A B.PNG')}`},
+		{"upper case function", `a{background:URL(a.png)}`, `a{background:url(A.PNG)}`},
+		{"spaces inside", `a{background:url( a.png )}`, `a{background:url(A.PNG)}`},
+		{"several", `a{b:url(x.png),url(y.png)}`, `a{b:url(X.PNG),url(Y.PNG)}`},
+		{"in a comment", `/* url(a.png) */a{}`, `/* url(a.png) */a{}`},
+		{"in a string", `a{content:"url(a.png)"}`, `a{content:"url(a.png)"}`},
+		{"part of a name", `a{b:myurl(a.png)}`, `a{b:myurl(a.png)}`},
+		{"unterminated", `a{b:url(a.png`, `a{b:url(a.png`},
+	}
+	for _, tt := range tests {
+		got := string(replaceCSSURLs([]byte(tt.src), strings.ToUpper))
+		if got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRewriteCSSURLs(t *testing.T) {
+	hh := testHoard(t, "/css-urls/", map[string]string{
+		"css/site.css":  `a{background:url(img/a.png)}b{background:url("img/missing.png?v=1")}c{background:url(/css-urls/img/b.png)}`,
+		"css/img/a.png": "png",
+		"img/b.png":     "png",
+	})
+
+	url, fb, err := loadBuffer("/css-urls/css/site.css")
+	if err != nil || url == "" {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"hashed", "url(" + nameToHash["/css-urls/css/img/a.png"] + ")"},
+		{"missing file", `url("/css-urls/css/img/missing.png?v=1")`},
+		{"absolute", "url(" + nameToHash["/css-urls/img/b.png"] + ")"},
+	}
+	for _, tt := range tests {
+		if !strings.Contains(string(fb.body), tt.want) {
+			t.Errorf("%s: %s does not contain %s", tt.name, fb.body, tt.want)
+		}
+	}
+	if _, ok := hh.Stashed["css/img/a.png"]; !ok {
+		t.Error("referenced asset was not stashed")
+	}
+}
+
+func TestFindCSSImports(t *testing.T) {
+	tests := []struct {
+		name       string
+		src        string
+		refs       []string
+		conditions []string
+	}{
+		{"string", `@import "a.css";`, []string{"a.css"}, []string{""}},
+		{"url", `@import url(b.css);`, []string{"b.css"}, []string{""}},
+		{"quoted url", `@import url('b.css');`, []string{"b.css"}, []string{""}},
+		{"media query", `@import "c.css" screen and (min-width: 10em);`, []string{"c.css"}, []string{"screen and (min-width: 10em)"}},
+		{"layer", `@import 'd.css' layer(base);`, []string{"d.css"}, []string{"layer(base)"}},
+		{"several", "@import \"a.css\";\n@import \"b.css\";\na{}", []string{"a.css", "b.css"}, []string{"", ""}},
+		{"upper case", `@IMPORT "a.css";`, []string{"a.css"}, []string{""}},
+		{"in a block", `@media print { @import "a.css"; }`, nil, nil},
+		{"in a comment", `/* @import "a.css"; */`, nil, nil},
+		{"in a string", `a{content:'@import "a.css";'}`, nil, nil},
+		{"other at-rule", `@imports "a.css";`, nil, nil},
+		{"no target", `@import;`, nil, nil},
+	}
+	for _, tt := range tests {
+		imports := findCSSImports([]byte(tt.src))
+		if len(imports) != len(tt.refs) {
+			t.Errorf("%s: found %d imports, want %d", tt.name, len(imports), len(tt.refs))
+			continue
+		}
+		for i, imp := range imports {
+			if imp.ref != tt.refs[i] || imp.conditions != tt.conditions[i] {
+				t.Errorf("%s: import %d is %q %q, want %q %q", tt.name, i, imp.ref, imp.conditions, tt.refs[i], tt.conditions[i])
+			}
+			if rule := tt.src[imp.start:imp.end]; !strings.HasPrefix(strings.ToLower(rule), "@import") || !strings.HasSuffix(rule, ";") {
+				t.Errorf("%s: import %d spans %q", tt.name, i, rule)
+			}
+		}
+	}
+}
+
+func TestInlineCSSImports(t *testing.T) {
+	testHoard(t, "/css-imports/", map[string]string{
+		"css/site.css":    "@import \"reset.css\";\n@import \"theme.css\";\nb{}",
+		"css/reset.css":   "r{}",
+		"css/theme.css":   "@import url(https://fonts.example/f.css);\n@import \"sub/x.css\" layer(base);\nt{}",
+		"css/print.css":   "@import \"theme.css\" print;\np{}",
+		"css/media.css":   "@import \"reset.css\" screen;",
+		"css/sub/x.css":   "x{}",
+		"css/layered.css": "@import 'sub/x.css' layer(base);\n@import \"/css-imports/css/reset.css\" supports(display: grid);",
+	})
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"css/site.css", "@import url(https://fonts.example/f.css);\n@import \"/css-imports/css/sub/x.css\" layer(base);\nr{}\n\n\n\nt{}\n\nb{}"},
+		{"css/print.css", "@import \"/css-imports/css/theme.css\" print;\n\np{}"},
+		{"css/media.css", "@media screen {\nr{}\n}\n"},
+		{"css/layered.css", "@import \"/css-imports/css/sub/x.css\" layer(base);\n@import \"/css-imports/css/reset.css\" supports(display: grid);\n\n"},
+	}
+	for _, tt := range tests {
+		_, fb, err := loadBuffer("/css-imports/" + tt.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(fb.body) != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, fb.body, tt.want)
+		}
+	}
+}
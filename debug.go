@@ -0,0 +1,59 @@
+package hoard
+
+import (
+	"html/template"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// Query parameter asking for a file as it is on disk
+const debugQuery = "debug"
+
+//
+// A tag for each file of a CSS or JS bundle, pointing at the unprocessed file
+// rather than the bundle
+//
+func debugTags(st *renderState, fb *FileBuffer, attrs Attrs) (template.HTML, error) {
+	tags := make([]string, 0, len(fb.deps))
+	for _, m := range fb.deps {
+		url := m.parent.Prefix + m.name + "?" + debugQuery
+		st.collect(url, nil, false)
+
+		wrap := wrapJS
+		if path.Ext(m.name) == ".css" {
+			wrap = wrapCSS
+		}
+		tag, err := wrap(m.parent, url, "", attrs)
+		if err != nil {
+			return "", err
+		}
+		tags = append(tags, string(tag))
+	}
+	return template.HTML(strings.Join(tags, "\n")), nil
+}
+
+//
+// Serve a file straight from the hoard directory, without processing or caching
+//
+func (hh *HoardHandler) serveRaw(w http.ResponseWriter, r *http.Request, name string) {
+	file, err := hh.Dir.Open(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil || stat.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	hh.ServeContent(w, r, name, stat.ModTime(), file)
+}
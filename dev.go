@@ -0,0 +1,517 @@
+package hoard
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Where pages listen for changes, under the hoard prefix
+	devEventsPath = "_hoard/events"
+
+	// How often the hoard directory is checked for changes
+	devPollInterval = 500 * time.Millisecond
+
+	// How often idle event streams get a comment, so proxies keep them open
+	devKeepAlive = 30 * time.Second
+
+	// Lines shown either side of the one an error points at
+	excerptContext = 2
+)
+
+// Finds the line an error message points at
+var errorLine = regexp.MustCompile(`line (\d+)`)
+
+// Client side of hoard_livereload, given the event streams to listen to
+const liveReloadScript = `(function() {
+	var errors = {};
+	function showErrors() {
+		var all = [];
+		Object.keys(errors).forEach(function(url) {
+			all = all.concat(errors[url]);
+		});
+		var overlay = document.getElementById("hoard-errors");
+		if (!all.length) {
+			if (overlay) {
+				overlay.remove();
+			}
+			return;
+		}
+		if (!overlay) {
+			overlay = document.createElement("div");
+			overlay.id = "hoard-errors";
+			overlay.style.cssText = "position:fixed;top:0;right:0;bottom:0;left:0;z-index:2147483647;overflow:auto;" +
+				"padding:2em;background:rgba(24,24,24,.94);color:#eee;font:14px/1.5 monospace";
+			document.body.appendChild(overlay);
+		}
+		overlay.textContent = "";
+		all.forEach(function(e) {
+			var name = document.createElement("div");
+			name.style.cssText = "margin-top:1em;color:#ff7070;font-weight:bold";
+			name.textContent = e.name;
+			var message = document.createElement("div");
+			message.style.whiteSpace = "pre-wrap";
+			message.textContent = e.error;
+			overlay.append(name, message);
+			if (e.excerpt) {
+				var excerpt = document.createElement("pre");
+				excerpt.style.cssText = "margin:.5em 0;padding:.5em;background:#000;color:#ccc";
+				excerpt.textContent = e.excerpt;
+				overlay.append(excerpt);
+			}
+		});
+	}
+
+	%s.forEach(function(url) {
+		var events = new EventSource(url);
+		events.addEventListener("errors", function(e) {
+			errors[url] = JSON.parse(e.data);
+			showErrors();
+		});
+		events.addEventListener("reload", function() {
+			location.reload();
+		});
+		events.addEventListener("css", function(e) {
+			var swaps = JSON.parse(e.data);
+			document.querySelectorAll("link[rel=stylesheet]").forEach(function(link) {
+				var next = swaps[new URL(link.href, location.href).pathname];
+				if (!next) {
+					return;
+				}
+				// Swap once the new sheet has loaded, so the page never goes unstyled
+				var copy = link.cloneNode();
+				copy.removeAttribute("integrity");
+				copy.href = next;
+				copy.onload = function() {
+					link.remove();
+				};
+				link.after(copy);
+			});
+		});
+	});
+})();`
+
+//
+// A problem building an asset, as it is shown on pages
+//
+type buildError struct {
+	Name    string `json:"name"`
+	Error   string `json:"error"`
+	Line    int    `json:"line,omitempty"`
+	Excerpt string `json:"excerpt,omitempty"`
+
+	count int // When it was kept, to tell it from problems of earlier builds
+}
+
+//
+// Watches a hoard directory and passes what changed on to every page listening
+//
+type devWatcher struct {
+	mu      sync.Mutex
+	clients map[chan string]bool
+	mods    map[string]time.Time
+}
+
+func (dw *devWatcher) subscribe() chan string {
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+	ch := make(chan string, 8)
+	dw.clients[ch] = true
+	return ch
+}
+
+func (dw *devWatcher) unsubscribe(ch chan string) {
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+	delete(dw.clients, ch)
+}
+
+//
+// Send an event to every page listening, skipping any that are not keeping up
+//
+func (dw *devWatcher) broadcast(msg string) {
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+	for ch := range dw.clients {
+		select {
+		case ch <- msg:
+		default:
+		}
+	}
+}
+
+//
+// Start watching the hoard directory, the first time it is needed
+//
+func (hh *HoardHandler) watch() *devWatcher {
+	hh.watchOnce.Do(func() {
+		dw := &devWatcher{
+			clients: make(map[chan string]bool),
+			mods:    hh.scan(),
+		}
+		unlock := lockStash()
+		hh.watcher = dw
+		unlock()
+		go hh.poll(dw)
+	})
+	return hh.watcher
+}
+
+//
+// Modification times of every file in the hoard directory, skipping hidden ones
+//
+func (hh *HoardHandler) scan() map[string]time.Time {
+	root := string(hh.Dir)
+	mods := make(map[string]time.Time)
+	filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if p != root && strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.IsDir() {
+			if rel, err := filepath.Rel(root, p); err == nil {
+				mods[filepath.ToSlash(rel)] = info.ModTime()
+			}
+		}
+		return nil
+	})
+	return mods
+}
+
+//
+// Check the hoard directory over and over, telling pages about every change
+//
+func (hh *HoardHandler) poll(dw *devWatcher) {
+	for range time.Tick(devPollInterval) {
+		mods := hh.scan()
+		changed := []string{}
+		for name, mod := range mods {
+			if old, ok := dw.mods[name]; !ok || !old.Equal(mod) {
+				changed = append(changed, name)
+			}
+		}
+		for name := range dw.mods {
+			if _, ok := mods[name]; !ok {
+				changed = append(changed, name)
+			}
+		}
+		dw.mods = mods
+
+		if len(changed) == 0 {
+			continue
+		}
+		sort.Strings(changed)
+		if msg := hh.devEvent(changed); msg != "" {
+			dw.broadcast(msg)
+		}
+	}
+}
+
+//
+// Make sure changed files, and everything built from them, are rebuilt the next
+// time they are loaded. Modification times only count whole seconds, which is
+// not enough when a file is saved twice in a row.
+//
+func (hh *HoardHandler) invalidate(changed []string) {
+	// Patterns are matched again, files may have been added or removed
+	hh.globs = make(map[string]*globMatch)
+
+	// Files under their own name, and module bundles which have none
+	buffers := []*FileBuffer{}
+	for key, fb := range hh.Stashed {
+		if key == fb.name {
+			buffers = append(buffers, fb)
+		}
+	}
+	for _, mb := range hh.modules {
+		buffers = append(buffers, mb.fb)
+	}
+
+	for _, fb := range buffers {
+		for _, name := range changed {
+			if fb.name == name {
+				fb.mod = -1
+			}
+			if _, ok := fb.files[name]; ok {
+				fb.files[name] = -1
+			}
+		}
+	}
+}
+
+//
+// Work out what pages have to do about changed files. Stylesheets are rebuilt so
+// pages can swap them for their new URLs, anything else needs a reload.
+//
+func (hh *HoardHandler) devEvent(changed []string) string {
+	defer lockStash()()
+	hh.invalidate(changed)
+
+	for _, name := range changed {
+		if path.Ext(name) != ".css" {
+			buf, _ := json.Marshal(changed)
+			return "event: reload\ndata: " + string(buf) + "\n\n"
+		}
+	}
+
+	// Rebuilding adds to the stash, so find the stylesheets first
+	names := []string{}
+	for key, fb := range hh.Stashed {
+		if key == fb.name && !fb.isMap && path.Ext(key) == ".css" {
+			names = append(names, key)
+		}
+	}
+	bundles := map[string][]string{}
+	for _, fb := range hh.bundleBuilds {
+		if path.Ext(fb.hashName) != ".css" {
+			continue
+		}
+		members := make([]string, len(fb.deps))
+		for i, m := range fb.deps {
+			members[i] = m.parent.Prefix + m.name
+		}
+		bundles[hh.Prefix+fb.hashName] = members
+	}
+
+	swaps := map[string]string{}
+	for _, name := range names {
+		old := nameToHash[hh.Prefix+name]
+		url, err := addResource(name, hh)
+		if err != nil {
+			hh.reportError(name, err)
+			continue
+		}
+		if url != old {
+			swaps[old] = url
+		}
+	}
+	for old, members := range bundles {
+		url, _, err := loadBundle(hh, members)
+		if err != nil {
+			hh.reportError(strings.Join(members, ", "), err)
+			continue
+		}
+		if url != old {
+			swaps[old] = url
+		}
+	}
+
+	if len(swaps) == 0 {
+		return ""
+	}
+	buf, _ := json.Marshal(swaps)
+	return "event: css\ndata: " + string(buf) + "\n\n"
+}
+
+//
+// Stream changes to a page as server-sent events
+//
+func (hh *HoardHandler) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	dw := hh.watch()
+	ch := dw.subscribe()
+	defer dw.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	// Pages find out about problems from before they started listening straight away
+	unlock := lockStash()
+	current := hh.errorsEvent()
+	unlock()
+	io.WriteString(w, current)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(devKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case msg := <-ch:
+			io.WriteString(w, msg)
+		case <-keepAlive.C:
+			io.WriteString(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+//
+// Keep the latest problem with an asset, telling pages about it if it is new
+//
+func (hh *HoardHandler) keepError(name string, err error) {
+	if !hh.Dev {
+		return
+	}
+	hh.errorCount++
+	if last, ok := hh.buildErrors[name]; ok && last.Error == err.Error() {
+		last.count = hh.errorCount
+		hh.buildErrors[name] = last
+		return
+	}
+
+	be := buildError{Name: name, Error: err.Error(), count: hh.errorCount}
+	if src := hh.source(name); src != nil {
+		be.Name = hh.Prefix + name
+		be.Line, be.Excerpt = excerpt(src, be.Error)
+	}
+	hh.buildErrors[name] = be
+	hh.pushErrors()
+}
+
+//
+// Forget the problem with an asset, telling pages if there was one
+//
+func (hh *HoardHandler) clearError(name string) {
+	if _, ok := hh.buildErrors[name]; ok {
+		delete(hh.buildErrors, name)
+		hh.pushErrors()
+	}
+}
+
+//
+// Start building an asset. Calling the returned function once it has built
+// forgets its last problem, unless the build ran into a new one.
+//
+func (hh *HoardHandler) building(name string) func() {
+	start := hh.errorCount
+	return func() {
+		if be, ok := hh.buildErrors[name]; ok && be.count <= start {
+			hh.clearError(name)
+		}
+	}
+}
+
+//
+// Keep or forget the problem with a bundle once it has loaded. A reused build
+// still has the problem it was built in spite of.
+//
+func (hh *HoardHandler) bundleBuilt(label string, fb *FileBuffer, err error) {
+	if err == nil && fb != nil {
+		err = fb.buildErr
+	}
+	if err != nil {
+		hh.keepError(label, err)
+	} else {
+		hh.clearError(label)
+	}
+}
+
+//
+// Tell pages listening about every problem the hoard has now
+//
+func (hh *HoardHandler) pushErrors() {
+	if hh.watcher != nil {
+		hh.watcher.broadcast(hh.errorsEvent())
+	}
+}
+
+//
+// Event listing every problem the hoard has, an empty list clears them
+//
+func (hh *HoardHandler) errorsEvent() string {
+	list := make([]buildError, 0, len(hh.buildErrors))
+	for _, be := range hh.buildErrors {
+		list = append(list, be)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	buf, _ := json.Marshal(list)
+	return "event: errors\ndata: " + string(buf) + "\n\n"
+}
+
+//
+// Original content of a file in the hoard directory, nil if there is no such file
+//
+func (hh *HoardHandler) source(name string) []byte {
+	file, err := hh.Dir.Open(name)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	src, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil
+	}
+	return src
+}
+
+//
+// Numbered lines around the one an error message points at, if it points at one
+//
+func excerpt(src []byte, msg string) (int, string) {
+	m := errorLine.FindStringSubmatch(msg)
+	if m == nil {
+		return 0, ""
+	}
+	line, _ := strconv.Atoi(m[1])
+	lines := strings.Split(strings.TrimSuffix(string(src), "\n"), "\n")
+	if line < 1 || line > len(lines) {
+		return 0, ""
+	}
+
+	var b strings.Builder
+	for i := line - excerptContext; i <= line+excerptContext; i++ {
+		if i < 1 || i > len(lines) {
+			continue
+		}
+		marker := " "
+		if i == line {
+			marker = ">"
+		}
+		fmt.Fprintf(&b, "%s %4d | %s\n", marker, i, strings.TrimRight(lines[i-1], "\r"))
+	}
+	return line, b.String()
+}
+
+//
+// Script keeping the page up to date with every hoard in development mode,
+// nothing if there are none
+//
+func liveReload(st *renderState) (template.HTML, error) {
+	urls := []string{}
+	for _, hh := range hoards {
+		if hh.Dev {
+			urls = append(urls, hh.Prefix+devEventsPath)
+		}
+	}
+	if len(urls) == 0 {
+		return "", nil
+	}
+	sort.Strings(urls)
+
+	// The encoder escapes <, > and & so the list cannot end the script early
+	buf, err := json.Marshal(urls)
+	if err != nil {
+		return "", err
+	}
+	content := fmt.Sprintf(liveReloadScript, buf)
+	st.recordInline(true, "hoard_livereload", content)
+	return renderInline("script", content, st.nonceAttrs())
+}
@@ -0,0 +1,182 @@
+package hoard
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bump whenever the cached output of the same input and config would change
+const cacheVersion = "1"
+
+// How long a temporary file is left alone, it could be a Put still writing, maybe
+// from another process sharing the directory
+const cacheTempGrace = 10 * time.Minute
+
+//
+// An on-disk store of minified output that survives restarts
+//
+type DiskCache struct {
+	Dir     string        // Directory holding the cache entries
+	MaxSize int64         // Total size in bytes to keep, 0 for no limit
+	MaxAge  time.Duration // Entries unused for this long are removed, 0 for no limit
+
+	mu   sync.Mutex
+	size int64 // Approximate total size of entries on disk
+}
+
+//
+// Open (creating if needed) a cache directory and prune stale entries from it
+//
+func NewDiskCache(dir string, maxSize int64, maxAge time.Duration) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	dc := &DiskCache{
+		Dir:     dir,
+		MaxSize: maxSize,
+		MaxAge:  maxAge,
+	}
+	if err := dc.Prune(); err != nil {
+		return nil, err
+	}
+	return dc, nil
+}
+
+//
+// Build a cache key from the source content and the config that produced the output
+//
+func cacheKey(src []byte, config ...string) string {
+	h := sha256.New()
+	h.Write([]byte(cacheVersion))
+	for _, c := range config {
+		h.Write([]byte{0})
+		h.Write([]byte(c))
+	}
+	h.Write([]byte{0})
+	h.Write(src)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+func (dc *DiskCache) path(key string) string {
+	return filepath.Join(dc.Dir, key+".min")
+}
+
+//
+// Look up an entry, marking it as recently used
+//
+func (dc *DiskCache) Get(key string) ([]byte, bool) {
+	p := dc.path(key)
+	buf, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, false
+	}
+
+	// Age is measured from last use rather than creation
+	now := time.Now()
+	os.Chtimes(p, now, now)
+	return buf, true
+}
+
+//
+// Store an entry, pruning the cache if it has grown past its size limit
+//
+func (dc *DiskCache) Put(key string, buf []byte) error {
+	// Write to a temporary file first so a crash never leaves a partial entry
+	tmp, err := ioutil.TempFile(dc.Dir, "tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	// An entry being replaced no longer counts towards the size
+	dc.mu.Lock()
+	var replaced int64
+	if info, err := os.Stat(dc.path(key)); err == nil {
+		replaced = info.Size()
+	}
+	if err := os.Rename(tmp.Name(), dc.path(key)); err != nil {
+		dc.mu.Unlock()
+		os.Remove(tmp.Name())
+		return err
+	}
+	dc.size += int64(len(buf)) - replaced
+	over := dc.MaxSize > 0 && dc.size > dc.MaxSize
+	dc.mu.Unlock()
+
+	if over {
+		return dc.Prune()
+	}
+	return nil
+}
+
+//
+// Remove entries older than MaxAge, then the least recently used ones until under MaxSize
+//
+func (dc *DiskCache) Prune() error {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	infos, err := ioutil.ReadDir(dc.Dir)
+	if err != nil {
+		return err
+	}
+
+	entries := make([]os.FileInfo, 0, len(infos))
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		// Leftovers from an interrupted Put
+		if strings.HasPrefix(info.Name(), "tmp-") {
+			if time.Since(info.ModTime()) > cacheTempGrace {
+				os.Remove(filepath.Join(dc.Dir, info.Name()))
+			}
+			continue
+		}
+		if !strings.HasSuffix(info.Name(), ".min") {
+			continue
+		}
+		if dc.MaxAge > 0 && time.Since(info.ModTime()) > dc.MaxAge {
+			os.Remove(filepath.Join(dc.Dir, info.Name()))
+			continue
+		}
+		entries = append(entries, info)
+	}
+
+	// Oldest first so they are the first to go
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ModTime().Before(entries[j].ModTime())
+	})
+
+	var total int64
+	for _, info := range entries {
+		total += info.Size()
+	}
+	for _, info := range entries {
+		if dc.MaxSize <= 0 || total <= dc.MaxSize {
+			break
+		}
+		if err := os.Remove(filepath.Join(dc.Dir, info.Name())); err == nil {
+			total -= info.Size()
+		}
+	}
+
+	dc.size = total
+	return nil
+}
@@ -0,0 +1,133 @@
+package hoard
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestCacheKey(t *testing.T) {
+	base := cacheKey([]byte("a{}"), "text/css", "text/css")
+	tests := []struct {
+		name string
+		key  string
+		same bool
+	}{
+		{"same input", cacheKey([]byte("a{}"), "text/css", "text/css"), true},
+		{"other content", cacheKey([]byte("b{}"), "text/css", "text/css"), false},
+		{"other type", cacheKey([]byte("a{}"), "text/javascript", "text/css"), false},
+		{"other config", cacheKey([]byte("a{}"), "text/css", "text/css,text/javascript"), false},
+		{"config split differently", cacheKey([]byte("a{}"), "text/csstext/css"), false},
+	}
+	for _, tt := range tests {
+		if (tt.key == base) != tt.same {
+			t.Errorf("%s: key %s, same as the base %v, want %v", tt.name, tt.key, tt.key == base, tt.same)
+		}
+	}
+}
+
+func cacheEntries(t *testing.T, dir string) []string {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestDiskCachePrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hoard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Entries last used an hour, two hours and three days ago, and temporary
+	// files of a Put that is still writing and one that was interrupted long ago
+	now := time.Now()
+	files := []struct {
+		name string
+		age  time.Duration
+	}{
+		{"new.min", time.Hour},
+		{"old.min", 2 * time.Hour},
+		{"stale.min", 72 * time.Hour},
+		{"tmp-writing", 0},
+		{"tmp-abandoned", 2 * cacheTempGrace},
+		{"other.txt", 72 * time.Hour},
+	}
+	for _, f := range files {
+		p := filepath.Join(dir, f.name)
+		if err := ioutil.WriteFile(p, []byte("0123456789"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(p, now.Add(-f.age), now.Add(-f.age)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dc, err := NewDiskCache(dir, 15, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"new.min", "other.txt", "tmp-writing"}
+	if got := cacheEntries(t, dir); !reflect.DeepEqual(got, want) {
+		t.Errorf("after pruning: %v, want %v", got, want)
+	}
+	if dc.size != 10 {
+		t.Errorf("size %d, want 10", dc.size)
+	}
+}
+
+func TestDiskCachePut(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hoard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dc, err := NewDiskCache(dir, 25, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Overwriting an entry does not count it twice
+	for i := 0; i < 5; i++ {
+		if err := dc.Put("a", []byte("0123456789")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if dc.size != 10 {
+		t.Errorf("size %d after overwriting one entry, want 10", dc.size)
+	}
+	if buf, ok := dc.Get("a"); !ok || string(buf) != "0123456789" {
+		t.Errorf("got %q %v", buf, ok)
+	}
+
+	// Going over the limit removes the least recently used entry
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(dc.path("a"), old, old)
+	if err := dc.Put("b", []byte("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	if err := dc.Put("c", []byte("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := dc.Get("a"); ok {
+		t.Error("least recently used entry was kept")
+	}
+	if want := []string{"b.min", "c.min"}; !reflect.DeepEqual(cacheEntries(t, dir), want) {
+		t.Errorf("entries %v, want %v", cacheEntries(t, dir), want)
+	}
+	if dc.size != 20 {
+		t.Errorf("size %d, want 20", dc.size)
+	}
+}
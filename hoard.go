@@ -11,69 +11,187 @@ import (
 	"time"
 	"mime"
 	"net/http"
+	"net/http/httputil"
 	"strings"
+	"sync"
 	"errors"
 	"crypto/md5"
+	"encoding/base64"
 	"html/template"
 
 	"github.com/tdewolff/minify"
 	"github.com/tdewolff/minify/css"
 	"github.com/tdewolff/minify/js"
+	"github.com/tdewolff/minify/html"
+	"github.com/tdewolff/minify/svg"
+	"github.com/tdewolff/minify/json"
+	"github.com/tdewolff/minify/xml"
 )
 
 
+// Media types that can be passed to Create for compression, and the type
+// their minifier is registered under
+var minifyTypes = map[string]string{
+	"text/css":               "text/css",
+	"text/javascript":        "text/javascript",
+	"application/javascript": "text/javascript",
+	"text/html":              "text/html",
+	"image/svg+xml":          "image/svg+xml",
+	"application/json":       "application/json",
+	"text/xml":               "text/xml",
+	"application/xml":        "text/xml",
+}
+
+
 type FileBuffer struct {
 	parent *HoardHandler // Handler responsiblef for this buffer
+	name   string        // Name of the source file, empty for bundles
 	mod    int64         // Last modification time
 
-	// Only one of the following should be set
-	buf    []byte        // This filebuffer has its own content
-	deps   []*FileBuffer // This filebuffer is a collection of other filebuffers
+	// Extra files the content was built from, with their modification times
+	files  map[string]int64
+
+	// Files the content links to, with the URLs they had when it was built
+	links  map[string]string
+
+	buf    []byte        // Content as it is served
+	deps   []*FileBuffer // Members this filebuffer was joined from, if it is a bundle
+
+	body      []byte     // Content without the trailer, what bundles are built from
+	trailer   []byte     // Appended when served, links the source map
+	mapURL    string     // URL of the source map for this content
+	sourceMap *sourceMap // Map of a single file, embedded in bundle maps
+	isMap     bool       // This filebuffer is itself a source map
+	integrity string     // Subresource integrity value of the served content
+
+	hashName string // Name a bundle is stashed under, from the hash of its content
+	members  string // URLs of the member versions a bundle was built from
+	etag     string // Entity tag sent with a bundle
+	gzipped  []byte // Gzip compressed content, if it is worth sending
+	buildErr error  // Problem a bundle was built in spite of, shown again while it is reused
 }
 
-func (fb *FileBuffer) Set(r io.Reader, ctype string) {
-	// Check if it is a type that needs to be minified
-	for _, t := range fb.parent.Types {
-		if strings.HasPrefix(ctype, t) {
-			// Found a matching mime type replace the reader
-			if t == "application/javascript" {
-				r = fb.parent.M.Reader("text/javascript", r)
-			} else {
-				r = fb.parent.M.Reader(t, r)
-			}
-			break
-		}
+func (fb *FileBuffer) Set(r io.Reader, ctype string) error {
+	// Read the original content
+	src, err := ioutil.ReadAll(r)
+	if err != nil {
+		fb.parent.reportError(fb.name, err)
+		return err
 	}
 
-	// Read from the reader to our buffer
-	buf, err := ioutil.ReadAll(r)
+	// Run it through the pipeline for its type
+	buf, tc, err := fb.parent.transform(fb.name, ctype, src)
 	if err != nil {
-		log.Println(err)
-	} else {
-		fb.buf = make([]byte, len(buf))
-		copy(fb.buf, buf)
+		return err
+	}
+
+	// Remember what went into it so changes there invalidate this buffer
+	fb.files = make(map[string]int64)
+	for _, dep := range tc.deps {
+		fb.files[dep] = fb.parent.modTime(dep)
 	}
+	fb.links = tc.links
+
+	fb.body = make([]byte, len(buf))
+	copy(fb.body, buf)
+
+	// Map processed content back to the original
+	fb.trailer, fb.mapURL, fb.sourceMap = nil, "", nil
+	mediatype := mediaType(ctype)
+	if fb.parent.SourceMaps && sourceMapComment(mediatype, "") != nil && !bytes.Equal(src, buf) {
+		if err := fb.setSourceMap(mediatype, alignSourceMap(fb.parent.Prefix+fb.name, src, buf)); err != nil {
+			fb.parent.reportError(fb.name, err)
+		}
+	}
+
+	fb.buf = append(fb.body[:len(fb.body):len(fb.body)], fb.trailer...)
+	return nil
 }
 
 
-// Return a new reader to the buffer content
-func (fb *FileBuffer) Get() (io.ReadSeeker, int) {
-	if fb.deps != nil {
-		// Dependant file buffer with no real content of its own
-		// Collect readers from all dependencides in order
-		readers := make([]io.ReadSeeker, 0)
-		tot_len := 0
-		for _, dep := range fb.deps {
-			reader, length := dep.Get()
-			readers = append(readers, reader)
-			tot_len += length
+//
+// Content as a base64 data URI, typed by the file's extension
+//
+func (fb *FileBuffer) dataURI() string {
+	ctype := mediaType(mime.TypeByExtension(path.Ext(fb.name)))
+	if ctype == "" {
+		ctype = "application/octet-stream"
+	}
+	return "data:" + ctype + ";base64," + base64.StdEncoding.EncodeToString(fb.body)
+}
+
+
+//
+// Check if any of the extra files this buffer was built from have changed, or if
+// any file it links to is now served under another URL. Getting that URL rebuilds
+// the linked file if it has to be, so a change anywhere down a chain of links
+// reaches every file above it.
+//
+func (fb *FileBuffer) depsModified() bool {
+	for name, mod := range fb.files {
+		if fb.parent.modTime(name) != mod {
+			return true
+		}
+	}
+	for name, url := range fb.links {
+		hh := hoardOf(name)
+		if hh == nil {
+			continue
 		}
+		// Files in an import cycle link each other by name, which never changes
+		if _, ok := hh.loading[hh.RemovePrefix(name)]; ok {
+			continue
+		}
+		if current, err := addResource(hh.RemovePrefix(name), hh); err != nil || current != url {
+			return true
+		}
+	}
+	return false
+}
+
 
-		// Build a multireader from the readers
-		return MultiReadSeeker(readers...), tot_len
+//
+// Minify content of a media type, reusing the on-disk cache if there is one
+//
+func (hh *HoardHandler) minify(t string, src []byte) ([]byte, error) {
+	mediatype, ok := minifyTypes[t]
+	if !ok {
+		mediatype = t
 	}
 
-	// Otherwise read out the data from the buffer
+	// Development keeps files readable, the minifier only checks them for errors
+	if hh.Dev {
+		if _, err := ioutil.ReadAll(hh.M.Reader(mediatype, bytes.NewReader(src))); err != nil {
+			return nil, err
+		}
+		return src, nil
+	}
+
+	var key string
+	if hh.Cache != nil {
+		key = cacheKey(src, mediatype, strings.Join(hh.Types, ","))
+		if buf, ok := hh.Cache.Get(key); ok {
+			return buf, nil
+		}
+	}
+
+	buf, err := ioutil.ReadAll(hh.M.Reader(mediatype, bytes.NewReader(src)))
+	if err != nil {
+		return nil, err
+	}
+
+	if hh.Cache != nil {
+		if err := hh.Cache.Put(key, buf); err != nil {
+			log.Println("Cannot write to minify cache: ", err)
+		}
+	}
+	return buf, nil
+}
+
+
+// Return a new reader to the buffer content
+func (fb *FileBuffer) Get() (io.ReadSeeker, int) {
+	// Bundles are joined when they are loaded, so every buffer has its own content
 	reader := bytes.NewReader(fb.buf)
 	return reader, len(fb.buf)
 }
@@ -88,6 +206,68 @@ type HoardHandler struct {
 	M       *minify.M
 	Types   []string
 	Stashed map[string]*FileBuffer
+	Cache   *DiskCache // Optional on-disk cache of minified output
+
+	// Processing steps run on files as they are stashed, keyed by media type prefix
+	Transformers map[string][]Transformer
+
+	// Bare module specifiers and the files they map to in hoard_importmap
+	Imports map[string]string
+
+	// Called whenever processing a file fails, defaults to logging the error
+	OnError func(name string, err error)
+
+	// Fail instead of falling back to the unprocessed content when a stage errors
+	Strict bool
+
+	// Generate source maps for processed CSS and JS, and bundles of them
+	SourceMaps bool
+
+	// Link source maps with a SourceMap header instead of a comment in the content
+	SourceMapHeader bool
+
+	// If set, only requests it approves may fetch source maps
+	SourceMapAccess func(r *http.Request) bool
+
+	// Digests for subresource integrity out of sha256, sha384 and sha512, defaults to sha384
+	Integrity []string
+
+	// Default attributes of generated script and stylesheet tags
+	ScriptAttrs Attrs
+	StyleAttrs  Attrs
+
+	// Wrap each script in a bundle in a function, so top level names stay its own
+	WrapBundledScripts bool
+
+	// Emit a tag for each file of a bundle it serves, pointing at the file as it is on disk
+	Debug bool
+
+	// Development mode, nothing is minified or cached by browsers, and pages using
+	// hoard_livereload update as files change
+	Dev bool
+
+	stats   Stats
+	loading map[string]int          // Files currently being added, by how deep, to catch cycles
+	cyclic  map[string]bool         // Modules in an import cycle, always linked by their name
+	modules map[string]moduleBundle // Bundles built by hoard_module, by entry point
+	bundles map[string][]string     // Bundles declared with DefineBundle, by name
+
+	// Latest build of each bundle, by the names of its members
+	bundleBuilds map[string]*FileBuffer
+
+	// Files each bundle pattern matched, by pattern
+	globs map[string]*globMatch
+
+	watchOnce sync.Once
+	watcher   *devWatcher
+
+	// Development server taking requests the hoard cannot serve, see DevProxy
+	proxy   *httputil.ReverseProxy
+	proxied []string // Patterns of names always left to it
+
+	// Last problem building each asset, kept in development mode to show on its pages
+	buildErrors map[string]buildError
+	errorCount  int
 }
 
 
@@ -99,13 +279,59 @@ func (hh *HoardHandler) RemovePrefix(in string) string {
 }
 
 
+//
+// Get the modification time of a file in the hoard, 0 if it cannot be found
+//
+func (hh *HoardHandler) modTime(name string) int64 {
+	info, err := os.Stat(path.Join(string(hh.Dir), name))
+	if err != nil {
+		return 0
+	}
+	return info.ModTime().Unix()
+}
+
+
+//
+// Get the buffer stashed under a name, adding the file if its not there yet
+//
+func (hh *HoardHandler) stashed(urlPath string) (*FileBuffer, error) {
+	if _, ok := hh.Stashed[urlPath]; !ok {
+		if _, err := addResource(urlPath, hh); err != nil {
+			return nil, err
+		}
+	}
+	return hh.Stashed[urlPath], nil
+}
+
+
 //
 // Serve HTTP function to make it a handler interface
 //
-func (hh HoardHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+func (hh *HoardHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Remove the leading prefix
 	urlPath := r.URL.Path[len(hh.Prefix):]
 
+	// Debug tags point at the file as it is on disk, which nothing else gets to see
+	if _, ok := r.URL.Query()[debugQuery]; ok {
+		if hh.Debug || stateFrom(r.Context()).debugging() {
+			hh.serveRaw(w, r, urlPath)
+		} else {
+			http.NotFound(w, r)
+		}
+		return
+	}
+
+	// Pages in development listen here for changes
+	if hh.Dev && urlPath == devEventsPath {
+		hh.serveEvents(w, r)
+		return
+	}
+
+	// Some files are always left to the development server
+	if hh.proxies(urlPath) {
+		hh.proxy.ServeHTTP(w, r)
+		return
+	}
 
 	var modTime time.Time
 	// Open the path from the base diretory
@@ -117,17 +343,59 @@ func (hh HoardHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		// Get modification time
 		fi, _ := file.Stat()
 		modTime = fi.ModTime()
+		file.Close()
 	}
 
-	//Serve content from the file or from the cache
-	if _, ok := hh.Stashed[urlPath]; !ok {
-		// Add the file if its not found
-		addResource(urlPath, &hh)
+	//Serve content from the file or from the cache, copying the buffer so it
+	//cannot be rebuilt halfway through the response
+	stashLock.Lock()
+	var fb FileBuffer
+	stashed, err := hh.stashed(urlPath)
+	if err == nil {
+		fb = *stashed
+	}
+	stashLock.Unlock()
+	if err != nil {
+		if os.IsNotExist(err) && hh.Dev && hh.proxy != nil {
+			hh.proxy.ServeHTTP(w, r)
+		} else if os.IsNotExist(err) {
+			http.NotFound(w, r)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// Nothing is kept for long while it is being worked on
+	if hh.Dev {
+		w.Header().Set("Cache-Control", "no-cache")
 	}
 
 	// Serve from cached map
-	fb, _ := hh.Stashed[urlPath]
+	if fb.isMap {
+		if hh.SourceMapAccess != nil && !hh.SourceMapAccess(r) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+	} else if fb.mapURL != "" && hh.SourceMapHeader {
+		w.Header().Set("SourceMap", fb.mapURL)
+	}
 	content, _ := fb.Get()
+
+	// Bundles can be revalidated and come compressed
+	etag := fb.etag
+	if fb.gzipped != nil {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if acceptsGzip(r) {
+			w.Header().Set("Content-Encoding", "gzip")
+			content = bytes.NewReader(fb.gzipped)
+			etag = strings.TrimSuffix(etag, `"`) + `-gzip"`
+		}
+	}
+	if etag != "" {
+		w.Header().Set("Etag", etag)
+	}
 	hh.ServeContent(w, r, urlPath, modTime, content)
 }
 
@@ -135,177 +403,396 @@ func (hh HoardHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 //
 // Set the location of a hoard and register a handler with http module
 //
-func Create(prefix string, dir http.Dir, compress []string) {
+func Create(prefix string, dir http.Dir, compress []string) (*HoardHandler, error) {
 	// Configure Minifier
 	m := minify.New()
 	for _, v := range compress {
-		if v == "text/css" {
-			m.AddFunc(v, css.Minify)
-		} else if v == "application/javascript" {
-			m.AddFunc("text/javascript", js.Minify)
+		mediatype, ok := minifyTypes[v]
+		if !ok {
+			return nil, fmt.Errorf("hoard: no minifier for media type %q", v)
+		}
+
+		switch mediatype {
+		case "text/css":
+			m.AddFunc(mediatype, css.Minify)
+		case "text/javascript":
+			m.AddFunc(mediatype, js.Minify)
+		case "text/html":
+			m.AddFunc(mediatype, html.Minify)
+		case "image/svg+xml":
+			m.AddFunc(mediatype, svg.Minify)
+		case "application/json":
+			m.AddFunc(mediatype, json.Minify)
+		case "text/xml":
+			m.AddFunc(mediatype, xml.Minify)
 		}
 	}
 
 	hh := HoardHandler{
-		Prefix:  prefix,
-		Dir:     dir,
-		M:       m,
-		Types:   compress,
-		Stashed: make(map[string]*FileBuffer),
+		Prefix:       prefix,
+		Dir:          dir,
+		M:            m,
+		Types:        compress,
+		Stashed:      make(map[string]*FileBuffer),
+		Transformers: make(map[string][]Transformer),
+		Imports:      make(map[string]string),
+		loading:      make(map[string]int),
+		cyclic:       make(map[string]bool),
+		modules:      make(map[string]moduleBundle),
+		bundles:      make(map[string][]string),
+		bundleBuilds: make(map[string]*FileBuffer),
+		globs:        make(map[string]*globMatch),
+		buildErrors:  make(map[string]buildError),
+	}
+
+	// Stylesheets are always flattened and link their assets by hash
+	hh.AddTransformer("text/css", InlineCSSImports)
+	hh.AddTransformer("text/css", RewriteCSSURLs)
+
+	// Modules import each other by hash too
+	hh.AddTransformer("text/javascript", RewriteJSImports)
+	hh.AddTransformer("application/javascript", RewriteJSImports)
+
+	// Minifying is the default pipeline for compressed types, under every
+	// name the type goes by since that depends on the system mime tables
+	added := make(map[string]bool)
+	for _, v := range compress {
+		for alias, mediatype := range minifyTypes {
+			if mediatype == minifyTypes[v] && !added[alias] {
+				hh.AddTransformer(alias, Minifier)
+				added[alias] = true
+			}
+		}
 	}
 
+	stashLock.Lock()
 	addHoard(&hh)
-	http.Handle(prefix, hh)
+	stashLock.Unlock()
+	http.Handle(prefix, &hh)
+	return &hh, nil
 }
 
 
 //
 // Preload a resource by adding it to the hoard
 //
-func preload(filePath string) string {
+func preload(filePath string) (string, error) {
 	// Find hoard it should belong to
-	for key, h := range hoards {
-		if strings.HasPrefix(filePath, key) {
-			return addResource(filePath[len(key):], h)
-		}
+	if hh := hoardOf(filePath); hh != nil {
+		return addResource(hh.RemovePrefix(filePath), hh)
 	}
 
-	return filePath
+	return filePath, nil
 }
 
 
 //
 // Add a resource to a hoard, or get its name if it already exists, returns the name
 //
-func addResource(name string, hh *HoardHandler) string {
+func addResource(name string, hh *HoardHandler) (string, error) {
+	// Files can load others while being processed, make sure that never loops
+	if _, ok := hh.loading[name]; ok {
+		return "", fmt.Errorf("hoard: %s depends on itself", name)
+	}
+	hh.loading[name] = len(hh.loading)
+	defer delete(hh.loading, name)
+
 	// Try to get the resource from the stash
 	if fb, ok := hh.Stashed[name]; ok {
-		// Check if the file has been modified since last time
-		info, _ := os.Stat(path.Join(string(hh.Dir), name))
-		last_mod := info.ModTime().Unix()
+		// Check if the file, or anything it was built from, has been modified since last time
+		last_mod := hh.modTime(name)
 
-		if last_mod > hh.Stashed[name].mod {
-			file, _ := hh.Dir.Open(name)
-			fb.Set(file, mime.TypeByExtension(path.Ext(name)))
+		if last_mod > hh.Stashed[name].mod || fb.depsModified() {
+			file, err := hh.Dir.Open(name)
+			if err != nil {
+				return "", err
+			}
+			defer file.Close()
+
+			// Keep serving the old content if the new one cannot be built
+			built := hh.building(name)
+			if err := fb.Set(file, mime.TypeByExtension(path.Ext(name))); err != nil {
+				return "", err
+			}
+			fb.mod = last_mod
+			fb.computeIntegrity()
+			built()
 			hash := fmt.Sprintf("%x%s", md5.Sum(fb.buf), path.Ext(name))
 			hh.Stashed[name] = fb
 			hh.Stashed[hash] = fb
-			nameToHash[name] = hh.Prefix + hash
-			return hh.Prefix + hash
+			nameToHash[hh.Prefix+name] = hh.servedURL(name, hash)
+			return nameToHash[hh.Prefix+name], nil
 		}
 
 		// It is already in the stash, return the hash for accessing it
-		return nameToHash[name]
+		return nameToHash[hh.Prefix+name], nil
 	} else {
 		// Not in the stash, add it now since it will be requested once this page loads
 		file, err := hh.Dir.Open(name)
 		if err != nil {
 			log.Println("Cannot find resource: ", name)
+			return "", err
 		}
+		defer file.Close()
 
-		stat, _ := file.Stat()
+		stat, err := file.Stat()
+		if err != nil {
+			return "", err
+		}
 
 		// Read file and get hash of contents
 		fb := &FileBuffer{
 			parent: hh,
+			name:   name,
 			mod:    stat.ModTime().Unix(),
 			buf:    make([]byte, 0),
 			deps:   nil,
 		}
-		fb.Set(file, mime.TypeByExtension(path.Ext(name)))
+		built := hh.building(name)
+		if err := fb.Set(file, mime.TypeByExtension(path.Ext(name))); err != nil {
+			return "", err
+		}
+		fb.computeIntegrity()
+		built()
 		hash := fmt.Sprintf("%x%s", md5.Sum(fb.buf), path.Ext(name))
 
 		// Finally save to stash with both the real name and hashed name
 		hh.Stashed[name] = fb
 		hh.Stashed[hash] = fb
 
-		nameToHash[name] = hh.Prefix + hash
-		return hh.Prefix + hash
+		nameToHash[hh.Prefix+name] = hh.servedURL(name, hash)
+		return nameToHash[hh.Prefix+name], nil
 	}
 }
 
 
 //
-// Add a block of resources
+// URL a file is linked by, its hashed name unless it is in an import cycle. A
+// module can only be loaded under one URL, and the members of a cycle cannot
+// all know each other's hash.
 //
-func multiLoad(names []string) (template.HTML, error) {
-	// Verify we have multiple files
-	if len(names) == 0 {
-		return "", errors.New("hoard_bundle tag with no filenames.")
-	} else if len(names) == 1 {
-		return "", errors.New("hoard_bundle tag with 1 file. Use the haord tag instead.")
+func (hh *HoardHandler) servedURL(name, hash string) string {
+	if hh.cyclic[name] {
+		return hh.Prefix + name
 	}
+	return hh.Prefix + hash
+}
 
-	// Housekeeping
-	buffers := make([]*FileBuffer, 0)
-	ctype := ""
-	ext := ""
-	var hh *HoardHandler
 
-	// Find hoard this block belongs to using the first filename
-	for key, h := range hoards {
-		if strings.HasPrefix(names[0], key) {
-			hh = h
+//
+// Mark every file being added from name onwards as part of an import cycle,
+// name being the one that would be added again
+//
+func (hh *HoardHandler) markCycle(name string) {
+	from := hh.loading[name]
+	for member, depth := range hh.loading {
+		if depth >= from {
+			hh.cyclic[member] = true
 		}
 	}
+}
 
 
-	// Concat names and get MD5
-	longName := strings.Join(names, "")
-	hash := fmt.Sprintf("%x%s", md5.Sum([]byte(longName)), path.Ext(names[0]))
-
-	// Check for existing hash, if it exists return early
-	if _, ok := hh.Stashed[hash]; ok {
-		if ext == ".css" {
-			return wrapCSS(hash), nil
-		} else if ext == ".js" {
-			return wrapJS(hash), nil
-		}
-	}
-
-	// It doesn't exist, we need to collect all the files and mark them as dependencies
-	// Go through each name
+//
+// Check that every file in a bundle has the same content type, and return it
+//
+func bundleType(names []string) (string, error) {
+	ctype := ""
 	for _, name := range names {
-		// Find hoard it should belong to
-		ext = path.Ext(name)
-		temp := mime.TypeByExtension(ext)
+		temp := mime.TypeByExtension(path.Ext(name))
 
 		// Verify it matches previous filetypes
 		if temp != ctype && ctype != "" {
 			return "", errors.New("Mismatched mimetype in hoard_bundle")
-		} else {
-			ctype = temp
+		}
+		ctype = temp
+	}
+	return ctype, nil
+}
+
+
+//
+// Load a block of resources into a single file, returning its url. Names may
+// be glob patterns. Each file comes from its own hoard, the bundle is served
+// by owner, or the hoard of the first file if that is nil.
+//
+func loadBundle(owner *HoardHandler, names []string) (url string, fb *FileBuffer, err error) {
+	// In development mode a bundle keeps its last problem until it builds without one
+	label := strings.Join(names, ", ")
+	dh := owner
+	if dh == nil && len(names) > 0 {
+		dh = hoardOf(names[0])
+	}
+	if dh != nil && dh.Dev {
+		defer func() {
+			dh.bundleBuilt(label, fb, err)
+		}()
+	}
+
+	// Verify we have multiple files, a pattern may match just one
+	if len(names) == 0 {
+		return "", nil, errors.New("hoard_bundle tag with no filenames.")
+	} else if len(names) == 1 && !isGlob(names[0]) {
+		return "", nil, errors.New("hoard_bundle tag with 1 file. Use the haord tag instead.")
+	}
+
+	// Patterns are checked on every load, so added and removed files are noticed
+	names, err = expandBundle(names)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(names) == 0 {
+		return "", nil, errors.New("hoard_bundle patterns matched no files.")
+	}
+
+	ctype, err := bundleType(names)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// Find hoard this block belongs to using the first filename
+	hh := owner
+	if hh == nil {
+		hh = hoardOf(names[0])
+	}
+	if hh == nil {
+		return "", nil, fmt.Errorf("%s is not in any hoard.", names[0])
+	}
+
+	// Concat names, a bundle is identified by what it is made of
+	longName := strings.Join(names, "")
+
+	// Collect all the files and mark them as dependencies
+	buffers := make([]*FileBuffer, 0)
+	versions := make([]string, 0)
+	for _, name := range names {
+		// Find hoard it should belong to
+		mh := hoardOf(name)
+		if mh == nil {
+			return "", nil, fmt.Errorf("%s is not in any hoard.", name)
 		}
 
 		// Get the hash of this dependency (load it if unloaded)
-		dep_hash := addResource(hh.RemovePrefix(name), hh)
+		dep_hash, err := addResource(mh.RemovePrefix(name), mh)
+		if err != nil {
+			return "", nil, err
+		}
+
+		// Add it to the list of dependencies, a bundle missing one would be wrong
+		new_dep, ok := mh.Stashed[mh.RemovePrefix(dep_hash)]
+		if !ok {
+			return "", nil, fmt.Errorf("hoard: failed to load %s for bundle", name)
+		}
+		buffers = append(buffers, new_dep)
+		versions = append(versions, dep_hash)
+	}
+
+	// Reuse the last build unless a member has changed since
+	members := strings.Join(versions, "\n")
+	if last, ok := hh.bundleBuilds[longName]; ok && last.members == members {
+		return hh.Prefix + last.hashName, last, nil
+	}
 
-		// Add it to the list of dependencies
-		if new_dep, ok := hh.Stashed[hh.RemovePrefix(dep_hash)]; ok {
-			buffers = append(buffers, new_dep)
+	// Join the members in a way that suits their type, and minify them as one
+	mediatype := mediaType(ctype)
+	joined, starts := hh.joinBundle(mediatype, buffers)
+	body := joined
+	var minifyErr error
+	if hh.minifies(mediatype) {
+		minified, err := hh.minify(mediatype, joined)
+		if err != nil {
+			hh.reportError(label, err)
+			if hh.Strict {
+				return "", nil, err
+			}
+			minifyErr = err
 		} else {
-			log.Println("Failed to load dependency", dep_hash)
+			body = minified
 		}
 	}
+	fb = &FileBuffer{
+		parent:   hh,
+		mod:      0,
+		body:     body,
+		deps:     buffers,
+		members:  members,
+		buildErr: minifyErr,
+	}
 
-	// Create a buffer with dependencies
-	fb := &FileBuffer{
-		parent: hh,
-		mod:    0,
-		buf:    nil,
-		deps:   buffers,
+
+	// Map the bundle back to each of its members
+	if hh.SourceMaps && sourceMapComment(mediatype, "") != nil {
+		var m interface{} = bundleSourceMap(hh, buffers, joined, starts)
+		if !bytes.Equal(body, joined) {
+			m = alignBundleSourceMap(buffers, body)
+		}
+		if err := fb.setSourceMap(mediatype, m); err != nil {
+			hh.reportError(label, err)
+		}
 	}
+	fb.buf = append(fb.body[:len(fb.body):len(fb.body)], fb.trailer...)
+
+	fb.computeIntegrity()
+	fb.compress()
+
+	// Save under the hash of its content only since this isnt a single file
+	fb.hashName = fmt.Sprintf("%x%s", md5.Sum(fb.buf), path.Ext(names[0]))
+	fb.etag = `"` + strings.TrimSuffix(fb.hashName, path.Ext(names[0])) + `"`
+	last := hh.bundleBuilds[longName]
+	hh.Stashed[fb.hashName] = fb
+	hh.bundleBuilds[longName] = fb
+	if last != nil {
+		hh.dropBuild(last)
+	}
+	return hh.Prefix + fb.hashName, fb, nil
+}
 
 
-	// Save under hash only since this isnt a single file
-	hh.Stashed[hash] = fb
+//
+// Remove a replaced bundle or module bundle build and its source map from the
+// stash, unless a current build has the same content
+//
+func (hh *HoardHandler) dropBuild(old *FileBuffer) {
+	keepBuild, keepMap := false, old.mapURL == ""
+	current := make([]*FileBuffer, 0, len(hh.bundleBuilds)+len(hh.modules))
+	for _, fb := range hh.bundleBuilds {
+		current = append(current, fb)
+	}
+	for _, mb := range hh.modules {
+		current = append(current, mb.fb)
+	}
+	for _, fb := range current {
+		keepBuild = keepBuild || fb.hashName == old.hashName
+		keepMap = keepMap || fb.mapURL == old.mapURL
+	}
+	if !keepBuild {
+		delete(hh.Stashed, old.hashName)
+	}
+	if !keepMap {
+		delete(hh.Stashed, strings.TrimPrefix(old.mapURL, hh.Prefix))
+	}
+}
+
+
+//
+// Add a block of resources
+//
+func multiLoad(st *renderState, owner *HoardHandler, names []string, attrs Attrs) (template.HTML, error) {
+	result, fb, err := loadBundle(owner, names)
+	if err != nil {
+		return "", err
+	}
+	ext := path.Ext(result)
+	if (ext == ".css" || ext == ".js") && (fb.parent.Debug || st.debugging()) {
+		return debugTags(st, fb, attrs)
+	}
+	st.collect(result, fb, false)
 
 	// Need to surround it in its tag
-	result := hh.Prefix + hash
 	if ext == ".css" {
-		return wrapCSS(result), nil
+		return wrapCSS(fb.parent, result, fb.integrity, attrs)
 	} else if ext == ".js" {
-		return wrapJS(result), nil
+		return wrapJS(fb.parent, result, fb.integrity, attrs)
 	}
 
 	return template.HTML(result), nil
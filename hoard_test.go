@@ -0,0 +1,68 @@
+package hoard
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Create a hoard over a temporary directory holding the given files
+func testHoard(t *testing.T, prefix string, files map[string]string, compress ...string) *HoardHandler {
+	dir, err := ioutil.TempDir("", "hoard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	for name, content := range files {
+		writeTestFile(t, dir, name, content)
+	}
+
+	hh, err := Create(prefix, http.Dir(dir), compress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hh
+}
+
+func writeTestFile(t *testing.T, dir, name, content string) {
+	full := filepath.Join(dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(full, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNestedHoards(t *testing.T) {
+	outer := testHoard(t, "/nested/", map[string]string{"site.css": "a{}", "vendor/lib.css": "outer{}"})
+	inner := testHoard(t, "/nested/vendor/", map[string]string{"lib.css": "inner{}", "lib.js": "inner()"})
+
+	// Try often enough that map order cannot pick the right hoard by chance
+	for i := 0; i < 20; i++ {
+		if hh := hoardOf("/nested/vendor/lib.css"); hh != inner {
+			t.Fatalf("hoardOf picked the hoard at %s", hh.Prefix)
+		}
+		if hh := hoardOf("/nested/site.css"); hh != outer {
+			t.Fatalf("hoardOf picked the hoard at %s", hh.Prefix)
+		}
+
+		_, fb, err := loadBuffer("/nested/vendor/lib.css")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fb.parent != inner || string(fb.body) != "inner{}" {
+			t.Fatalf("loaded %q from the hoard at %s", fb.body, fb.parent.Prefix)
+		}
+
+		url, err := preload("/nested/vendor/lib.js")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := inner.Stashed[inner.RemovePrefix(url)]; !ok {
+			t.Fatalf("preloaded %s into the wrong hoard", url)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package hoard
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+// Digests computed for subresource integrity when a hoard does not say otherwise
+var defaultIntegrity = []string{"sha384"}
+
+var integrityHashes = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha384": sha512.New384,
+	"sha512": sha512.New,
+}
+
+//
+// Compute the integrity value of the exact bytes a file buffer serves
+//
+func (fb *FileBuffer) computeIntegrity() {
+	algs := fb.parent.Integrity
+	if algs == nil {
+		algs = defaultIntegrity
+	}
+
+	values := make([]string, 0, len(algs))
+	for _, alg := range algs {
+		newHash, ok := integrityHashes[alg]
+		if !ok {
+			fb.parent.reportError(fb.name, fmt.Errorf("hoard: unknown integrity algorithm %q", alg))
+			continue
+		}
+
+		h := newHash()
+		content, _ := fb.Get()
+		io.Copy(h, content)
+		values = append(values, alg+"-"+base64.StdEncoding.EncodeToString(h.Sum(nil)))
+	}
+	fb.integrity = strings.Join(values, " ")
+}
+
+//
+// Attributes adding an integrity check to a tag, none if there is nothing to check
+//
+func integrityAttrs(integrity string) Attrs {
+	if integrity == "" {
+		return nil
+	}
+	return Attrs{{Name: "integrity", Value: integrity}, {Name: "crossorigin", Value: "anonymous"}}
+}
@@ -0,0 +1,135 @@
+package hoard
+
+import (
+	"bytes"
+	"strings"
+)
+
+var utf8BOM = []byte("\xef\xbb\xbf")
+
+//
+// Copy content with part of it blanked out. Newlines are kept and everything else
+// becomes spaces, so positions in the rest of it, and its source map, still hold.
+//
+func blankOut(content []byte, start, end int) []byte {
+	out := append([]byte(nil), content...)
+	for i := start; i < end; i++ {
+		if out[i] != '\n' {
+			out[i] = ' '
+		}
+	}
+	return out
+}
+
+//
+// Replace a byte order mark, which is only allowed at the very start of a file,
+// with a space taking up the same single column
+//
+func blankBOM(content []byte) []byte {
+	if !bytes.HasPrefix(content, utf8BOM) {
+		return content
+	}
+	return append([]byte(" "), content[len(utf8BOM):]...)
+}
+
+//
+// Join the members of a bundle so each one parses the same as it would on its
+// own. Returns the content and where each member starts in it.
+//
+func (hh *HoardHandler) joinBundle(mediatype string, members []*FileBuffer) ([]byte, []int) {
+	switch {
+	case mediatype == "text/css":
+		return joinCSS(members)
+	case strings.HasSuffix(mediatype, "javascript"):
+		return joinJS(members, hh.WrapBundledScripts)
+	}
+
+	var out bytes.Buffer
+	starts := make([]int, len(members))
+	for i, m := range members {
+		starts[i] = out.Len()
+		out.Write(m.body)
+	}
+	return out.Bytes(), starts
+}
+
+//
+// Scripts end with a semicolon on a line of its own, so neither a missing
+// semicolon nor a trailing line comment runs into the next one. Each can be
+// wrapped in a function to keep its top level declarations to itself.
+//
+func joinJS(members []*FileBuffer, wrap bool) ([]byte, []int) {
+	var out bytes.Buffer
+	starts := make([]int, len(members))
+	for i, m := range members {
+		if wrap {
+			out.WriteString("(function(){\n")
+		}
+		starts[i] = out.Len()
+		out.Write(blankBOM(m.body))
+		if len(m.body) > 0 && m.body[len(m.body)-1] != '\n' {
+			out.WriteByte('\n')
+		}
+		if wrap {
+			out.WriteString("})();\n")
+		} else {
+			out.WriteString(";\n")
+		}
+	}
+	return out.Bytes(), starts
+}
+
+//
+// Stylesheets only allow @charset as the very first thing and @import before any
+// other rule, so both are moved from the members to the top of the bundle. Only
+// the first @charset is kept, the rest of the bundle is read with it anyway.
+//
+func joinCSS(members []*FileBuffer) ([]byte, []int) {
+	charset := ""
+	var imports []string
+	seen := map[string]bool{}
+	contents := make([][]byte, len(members))
+	for i, m := range members {
+		content := blankBOM(m.body)
+		// A @charset may follow the byte order mark, now a single space
+		at := 0
+		if bytes.HasPrefix(m.body, utf8BOM) {
+			at = 1
+		}
+		if hasPrefixFold(content[at:], "@charset") {
+			if end := bytes.IndexByte(content, ';'); end >= 0 {
+				if charset == "" {
+					charset = string(content[at : end+1])
+				}
+				content = blankOut(content, 0, end+1)
+			}
+		}
+		for _, imp := range findCSSImports(content) {
+			rule := string(content[imp.start:imp.end])
+			if !seen[rule] {
+				seen[rule] = true
+				imports = append(imports, rule)
+			}
+			content = blankOut(content, imp.start, imp.end)
+		}
+		contents[i] = content
+	}
+
+	var out bytes.Buffer
+	if charset != "" {
+		out.WriteString(charset + "\n")
+	}
+	for _, rule := range imports {
+		out.WriteString(rule + "\n")
+	}
+
+	starts := make([]int, len(members))
+	for i, content := range contents {
+		starts[i] = out.Len()
+		out.Write(content)
+		if len(content) > 0 && content[len(content)-1] != '\n' {
+			out.WriteByte('\n')
+		}
+	}
+	return out.Bytes(), starts
+}
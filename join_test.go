@@ -0,0 +1,84 @@
+package hoard
+
+import (
+	"reflect"
+	"testing"
+)
+
+func members(contents ...string) []*FileBuffer {
+	fbs := make([]*FileBuffer, len(contents))
+	for i, c := range contents {
+		fbs[i] = &FileBuffer{body: []byte(c)}
+	}
+	return fbs
+}
+
+func TestBlankOut(t *testing.T) {
+	if got := string(blankOut([]byte("ab\ncd;ef"), 1, 6)); got != "a \n   ef" {
+		t.Errorf("got %q", got)
+	}
+	if got := string(blankBOM([]byte("\xef\xbb\xbfa"))); got != " a" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestJoinJS(t *testing.T) {
+	tests := []struct {
+		name    string
+		members []string
+		wrap    bool
+		want    string
+		starts  []int
+	}{
+		{"plain", []string{"a()\n", "b()"}, false, "a()\n;\nb()\n;\n", []int{0, 6}},
+		{"line comment", []string{"a() // done", "b()"}, false, "a() // done\n;\nb()\n;\n", []int{0, 14}},
+		{"byte order mark", []string{"\xef\xbb\xbfa()"}, false, " a()\n;\n", []int{0}},
+		{"empty", []string{"", "b()"}, false, ";\nb()\n;\n", []int{0, 2}},
+		{"wrapped", []string{"var a = 1", "var a = 2"}, true, "(function(){\nvar a = 1\n})();\n(function(){\nvar a = 2\n})();\n", []int{13, 42}},
+	}
+	for _, tt := range tests {
+		out, starts := joinJS(members(tt.members...), tt.wrap)
+		if string(out) != tt.want || !reflect.DeepEqual(starts, tt.starts) {
+			t.Errorf("%s: got %q %v, want %q %v", tt.name, out, starts, tt.want, tt.starts)
+		}
+	}
+}
+
+func TestJoinCSS(t *testing.T) {
+	tests := []struct {
+		name    string
+		members []string
+		want    string
+		starts  []int
+	}{
+		{"plain", []string{"a{}", "b{}\n"}, "a{}\nb{}\n", []int{0, 4}},
+		{"charset", []string{"@charset \"utf-8\";a{}", "@charset \"latin1\";b{}"}, "@charset \"utf-8\";\n                 a{}\n                  b{}\n", []int{18, 39}},
+		{"imports", []string{"@import \"x.css\";a{}", "@import url(y.css) print;\n@import \"x.css\";b{}"}, "@import \"x.css\";\n@import url(y.css) print;\n                a{}\n                         \n                b{}\n", []int{43, 63}},
+		{"byte order mark", []string{"\xef\xbb\xbf@charset \"utf-8\";a{}"}, "@charset \"utf-8\";\n                  a{}\n", []int{18}},
+		{"nested import", []string{"@media print{@import \"x.css\";}"}, "@media print{@import \"x.css\";}\n", []int{0}},
+	}
+	for _, tt := range tests {
+		out, starts := joinCSS(members(tt.members...))
+		if string(out) != tt.want || !reflect.DeepEqual(starts, tt.starts) {
+			t.Errorf("%s: got %q %v, want %q %v", tt.name, out, starts, tt.want, tt.starts)
+		}
+	}
+}
+
+func TestJoinBundle(t *testing.T) {
+	hh := &HoardHandler{}
+	tests := []struct {
+		mediatype string
+		want      string
+	}{
+		{"text/css", "a\nb\n"},
+		{"text/javascript", "a\n;\nb\n;\n"},
+		{"application/javascript", "a\n;\nb\n;\n"},
+		{"image/svg+xml", "ab"},
+	}
+	for _, tt := range tests {
+		if out, _ := hh.joinBundle(tt.mediatype, members("a", "b")); string(out) != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.mediatype, out, tt.want)
+		}
+	}
+}
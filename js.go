@@ -0,0 +1,262 @@
+package hoard
+
+import (
+	"bytes"
+	"strings"
+)
+
+//
+// Rewrites relative static and dynamic import specifiers in JS to hashed URLs
+//
+var RewriteJSImports Transformer = jsImportRewriter{}
+
+type jsImportRewriter struct{}
+
+func (jsImportRewriter) Transform(tc *TransformContext, src []byte) ([]byte, error) {
+	return replaceJSImports(src, func(spec string) string {
+		// Bare specifiers are left to the import map
+		if !strings.HasPrefix(spec, "./") && !strings.HasPrefix(spec, "../") && !strings.HasPrefix(spec, "/") {
+			return spec
+		}
+
+		// A module importing one that is still being added closes a cycle, and
+		// every module in it is linked by its name instead
+		file, suffix := splitRef(spec)
+		name, ok := tc.resolveName(file)
+		if _, loading := tc.Hoard.loading[name]; ok && loading {
+			tc.Hoard.markCycle(name)
+			return tc.Hoard.Prefix + name + suffix
+		}
+
+		return tc.resolveURL(spec)
+	}), nil
+}
+
+const (
+	jsIdent = iota
+	jsString
+	jsPunct
+	jsOther
+)
+
+//
+// A token of JS source, only as detailed as finding imports needs
+//
+type jsToken struct {
+	kind       int
+	start, end int
+}
+
+func isJSIdentByte(c byte) bool {
+	return c == '_' || c == '$' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
+
+// Keywords after which a slash starts a regular expression rather than a division
+var jsRegexKeywords = map[string]bool{
+	"return": true, "typeof": true, "instanceof": true, "in": true, "of": true, "new": true,
+	"delete": true, "void": true, "throw": true, "case": true, "do": true, "else": true, "yield": true, "await": true,
+}
+
+//
+// Split JS source into tokens, skipping whitespace, comments, template literals and regular expressions
+//
+func tokenizeJS(src []byte) []jsToken {
+	var tokens []jsToken
+	regexAllowed := true
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '/' && i+1 < len(src) && src[i+1] == '/':
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case c == '/' && i+1 < len(src) && src[i+1] == '*':
+			if end := bytes.Index(src[i+2:], []byte("*/")); end >= 0 {
+				i += 2 + end + 2
+			} else {
+				i = len(src)
+			}
+		case c == '\'' || c == '"':
+			start := i
+			for i++; i < len(src) && src[i] != c && src[i] != '\n'; i++ {
+				if src[i] == '\\' {
+					i++
+				}
+			}
+			i++
+			if i > len(src) {
+				i = len(src)
+			}
+			tokens = append(tokens, jsToken{jsString, start, i})
+			regexAllowed = false
+		case c == '`':
+			start := i
+			i = skipJSTemplate(src, i)
+			tokens = append(tokens, jsToken{jsOther, start, i})
+			regexAllowed = false
+		case c == '/' && regexAllowed:
+			start := i
+			i = skipJSRegex(src, i)
+			tokens = append(tokens, jsToken{jsOther, start, i})
+			regexAllowed = false
+		case isJSIdentByte(c):
+			start := i
+			for i < len(src) && isJSIdentByte(src[i]) {
+				i++
+			}
+			tokens = append(tokens, jsToken{jsIdent, start, i})
+			regexAllowed = jsRegexKeywords[string(src[start:i])]
+		default:
+			tokens = append(tokens, jsToken{jsPunct, i, i + 1})
+			regexAllowed = c != ')' && c != ']' && c != '}'
+			i++
+		}
+	}
+	return tokens
+}
+
+//
+// Find the end of a template literal starting at i, including any nested expressions
+//
+func skipJSTemplate(src []byte, i int) int {
+	for i++; i < len(src); i++ {
+		switch src[i] {
+		case '\\':
+			i++
+		case '`':
+			return i + 1
+		case '$':
+			if i+1 < len(src) && src[i+1] == '{' {
+				depth := 0
+				for i++; i < len(src); i++ {
+					if src[i] == '{' {
+						depth++
+					} else if src[i] == '}' {
+						depth--
+						if depth == 0 {
+							break
+						}
+					} else if src[i] == '`' {
+						i = skipJSTemplate(src, i) - 1
+					}
+				}
+			}
+		}
+	}
+	return len(src)
+}
+
+//
+// Find the end of a regular expression literal starting at i
+//
+func skipJSRegex(src []byte, i int) int {
+	inClass := false
+	for i++; i < len(src); i++ {
+		switch src[i] {
+		case '\\':
+			i++
+		case '[':
+			inClass = true
+		case ']':
+			inClass = false
+		case '\n':
+			return i
+		case '/':
+			if !inClass {
+				i++
+				for i < len(src) && isJSIdentByte(src[i]) {
+					i++
+				}
+				return i
+			}
+		}
+	}
+	return len(src)
+}
+
+//
+// Find the string tokens holding module specifiers: import "x", import(... "x"),
+// import ... from "x" and export ... from "x"
+//
+func findJSSpecifiers(src []byte, tokens []jsToken) []jsToken {
+	text := func(t jsToken) string { return string(src[t.start:t.end]) }
+	isPunct := func(i int, p string) bool { return i >= 0 && i < len(tokens) && tokens[i].kind == jsPunct && text(tokens[i]) == p }
+
+	var specs []jsToken
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		if t.kind != jsIdent || (text(t) != "import" && text(t) != "export") {
+			continue
+		}
+		// Property access such as import.meta or obj.import
+		if isPunct(i-1, ".") || isPunct(i+1, ".") {
+			continue
+		}
+
+		keyword := text(t)
+		switch {
+		case keyword == "import" && i+1 < len(tokens) && tokens[i+1].kind == jsString:
+			specs = append(specs, tokens[i+1])
+		case keyword == "import" && isPunct(i+1, "("):
+			if i+2 < len(tokens) && tokens[i+2].kind == jsString && (isPunct(i+3, ")") || isPunct(i+3, ",")) {
+				specs = append(specs, tokens[i+2])
+			}
+		case keyword == "export" && !isPunct(i+1, "{") && !isPunct(i+1, "*"):
+			// A declaration, there is no specifier
+		default:
+			// Look for the from clause, only names and braces can come before it
+			for j := i + 1; j < len(tokens); j++ {
+				tj := tokens[j]
+				if tj.kind == jsIdent && text(tj) == "from" && j+1 < len(tokens) && tokens[j+1].kind == jsString {
+					specs = append(specs, tokens[j+1])
+					i = j + 1
+					break
+				}
+				if tj.kind == jsPunct && !strings.Contains("{},*", text(tj)) {
+					break
+				}
+				if tj.kind != jsIdent && tj.kind != jsPunct {
+					break
+				}
+			}
+		}
+	}
+	return specs
+}
+
+//
+// Call fn on every module specifier in JS source, replacing it with the result
+//
+func replaceJSImports(src []byte, fn func(spec string) string) []byte {
+	specs := findJSSpecifiers(src, tokenizeJS(src))
+
+	var out bytes.Buffer
+	last := 0
+	for _, s := range specs {
+		if s.end-s.start < 2 {
+			continue
+		}
+		quote := src[s.start]
+		spec := string(src[s.start+1 : s.end-1])
+		if strings.ContainsAny(spec, "\\\n") {
+			continue
+		}
+		replaced := fn(spec)
+		if replaced == spec {
+			continue
+		}
+		out.Write(src[last:s.start])
+		out.WriteByte(quote)
+		out.WriteString(strings.Replace(replaced, string(quote), "\\"+string(quote), -1))
+		out.WriteByte(quote)
+		last = s.end
+	}
+
+	if last == 0 {
+		return src
+	}
+	out.Write(src[last:])
+	return out.Bytes()
+}
@@ -0,0 +1,93 @@
+package hoard
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFindJSSpecifiers(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want []string
+	}{
+		{"default import", `import a from "./a.js"`, []string{"./a.js"}},
+		{"side effect import", `import './side.js';`, []string{"./side.js"}},
+		{"named import", `import { x as y, z } from '../b.js'`, []string{"../b.js"}},
+		{"namespace import", `import * as ns from "/static/c.js"`, []string{"/static/c.js"}},
+		{"default and named", `import d, { e } from "./d.js"`, []string{"./d.js"}},
+		{"export star", `export * from "./e.js"`, []string{"./e.js"}},
+		{"export named from", `export { f as g } from "./f.js"`, []string{"./f.js"}},
+		{"dynamic import", `const m = await import("./g.js")`, []string{"./g.js"}},
+		{"dynamic import with options", `import("./h.js", { with: { type: "json" } })`, []string{"./h.js"}},
+		{"dynamic import of an expression", `import("./" + name)`, nil},
+		{"bare specifier", `import React from "react"`, []string{"react"}},
+		{"several", "import a from './a.js'\nimport b from './b.js'\nexport * from './c.js'", []string{"./a.js", "./b.js", "./c.js"}},
+		{"import meta", `console.log(import.meta.url, "./no.js")`, nil},
+		{"method named import", `loader.import("./no.js")`, nil},
+		{"export declaration", `export const x = "./no.js"`, nil},
+		{"in a string", `const s = "import x from './no.js'"`, nil},
+		{"in a comment", "// import x from './no.js'\n/* import './no.js' */", nil},
+		{"in a template literal", "const s = `import x from './no.js'`", nil},
+		{"in a regular expression", `const r = /import "x"/g`, nil},
+		{"division is not a regular expression", `const q = a / b; import "./after.js"`, []string{"./after.js"}},
+	}
+	for _, tt := range tests {
+		src := []byte(tt.src)
+		var got []string
+		for _, tok := range findJSSpecifiers(src, tokenizeJS(src)) {
+			got = append(got, string(src[tok.start+1:tok.end-1]))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestJSImportChain(t *testing.T) {
+	hh := testHoard(t, "/js-chain/", map[string]string{
+		"a.js":     `import { b } from "./lib/b.js"; b()`,
+		"lib/b.js": `import { c } from "./c.js"; export function b() { c() }`,
+		"lib/c.js": `export function c() {}`,
+		"d.js":     `import "./lib/missing.js"`,
+	})
+	a, err := addResource("a.js", hh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := nameToHash["/js-chain/lib/b.js"]
+	c := nameToHash["/js-chain/lib/c.js"]
+	if body := string(hh.Stashed["a.js"].body); !strings.Contains(body, `"`+b+`"`) {
+		t.Errorf("a.js imports %s, want %s", body, b)
+	}
+	if body := string(hh.Stashed["lib/b.js"].body); !strings.Contains(body, `"`+c+`"`) {
+		t.Errorf("b.js imports %s, want %s", body, c)
+	}
+
+	// Specifiers that cannot be hashed still have to resolve from the top of the hoard
+	addResource("d.js", hh)
+	if body := string(hh.Stashed["d.js"].body); body != `import "/js-chain/lib/missing.js"` {
+		t.Errorf("unhashed specifier: got %s", body)
+	}
+
+	// Editing the end of the chain changes the URL of every module above it
+	writeTestFile(t, string(hh.Dir), "lib/c.js", `export function c() { return 1 }`)
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(string(hh.Dir), "lib/c.js"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	a2, err := addResource("a.js", hh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a2 == a || nameToHash["/js-chain/lib/b.js"] == b || nameToHash["/js-chain/lib/c.js"] == c {
+		t.Errorf("editing c.js left URLs unchanged: a.js %s -> %s, b.js %s -> %s", a, a2, b, nameToHash["/js-chain/lib/b.js"])
+	}
+	if body := string(hh.Stashed["lib/b.js"].body); !strings.Contains(body, nameToHash["/js-chain/lib/c.js"]) {
+		t.Errorf("b.js still imports the old c.js: %s", body)
+	}
+}
@@ -0,0 +1,46 @@
+package hoard
+
+//
+// Where a file or bundle is served from
+//
+type ManifestEntry struct {
+	URL       string   `json:"url"`
+	Integrity string   `json:"integrity,omitempty"`
+	Members   []string `json:"members,omitempty"` // Files making up a bundle, in order
+}
+
+//
+// Every file loaded into the hoard so far, by the name templates use for it, and
+// every bundle declared with DefineBundle, by its name. Loading is brought up to
+// date first, so the URLs are the ones pages would get now.
+//
+func (hh *HoardHandler) Manifest() (map[string]ManifestEntry, error) {
+	defer lockStash()()
+
+	// Loading adds to the stash, so find the names first
+	names := []string{}
+	for key, fb := range hh.Stashed {
+		if key == fb.name && fb.name != "" && !fb.isMap {
+			names = append(names, key)
+		}
+	}
+
+	manifest := map[string]ManifestEntry{}
+	for _, name := range names {
+		url, err := addResource(name, hh)
+		if err != nil {
+			return nil, err
+		}
+		manifest[hh.Prefix+name] = ManifestEntry{URL: url, Integrity: hh.Stashed[name].integrity}
+	}
+
+	for name, members := range hh.bundles {
+		url, fb, err := loadBundle(hh, members)
+		if err != nil {
+			return nil, err
+		}
+		files, _ := expandBundle(members)
+		manifest[name] = ManifestEntry{URL: url, Integrity: fb.integrity, Members: files}
+	}
+	return manifest, nil
+}
@@ -0,0 +1,1174 @@
+package hoard
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"path"
+	"sort"
+	"strings"
+)
+
+//
+// A binding brought in by an import statement
+//
+type esBinding struct {
+	imported string // Name exported by the other module, * for the namespace
+	local    string // Name it is bound to in this module
+}
+
+//
+// An import statement, or an export ... from statement
+//
+type esImport struct {
+	spec     string
+	dep      string // Name of the module in the hoard, empty if it is external
+	bindings []esBinding
+}
+
+//
+// A name exported by a module
+//
+type esExport struct {
+	name     string // Name it is exported as
+	local    string // Local binding, empty if it is a re-export
+	from     int    // Index of the import a re-export comes from
+	imported string // Name in the module it is re-exported from, * for the namespace
+}
+
+//
+// A piece of source to replace
+//
+type esEdit struct {
+	start, end int
+	text       string
+}
+
+//
+// An ES module split into what it imports, what it exports and the rest of its body
+//
+type esModule struct {
+	name      string
+	src       []byte
+	imports   []esImport
+	exports   []esExport
+	stars     []int // Imports re-exported with export *
+	topLevel  []string
+	refs      map[string]bool // Every name the module mentions, wherever it is bound
+	edits     []esEdit
+	complex   bool // Something was found that only the module registry can handle
+	defaultID string
+}
+
+func (m *esModule) text(t jsToken) string {
+	return string(m.src[t.start:t.end])
+}
+
+// Statement keywords, a line starting with one of these ends the previous statement
+var jsStatementKeywords = map[string]bool{
+	"const": true, "let": true, "var": true, "function": true, "class": true, "if": true, "for": true,
+	"while": true, "do": true, "return": true, "import": true, "export": true, "switch": true, "try": true,
+	"throw": true, "async": true,
+}
+
+//
+// Parser over the tokens of a single module
+//
+type esParser struct {
+	m      *esModule
+	tokens []jsToken
+}
+
+func (p *esParser) is(i int, kind int, text string) bool {
+	return i >= 0 && i < len(p.tokens) && p.tokens[i].kind == kind && p.m.text(p.tokens[i]) == text
+}
+
+func (p *esParser) ident(i int) (string, bool) {
+	if i < len(p.tokens) && p.tokens[i].kind == jsIdent {
+		return p.m.text(p.tokens[i]), true
+	}
+	return "", false
+}
+
+func (p *esParser) spec(i int) (string, bool) {
+	if i < len(p.tokens) && p.tokens[i].kind == jsString {
+		t := p.tokens[i]
+		if t.end-t.start >= 2 {
+			return string(p.m.src[t.start+1 : t.end-1]), true
+		}
+	}
+	return "", false
+}
+
+//
+// Check if a line break separates two tokens
+//
+func (p *esParser) newline(i int) bool {
+	if i <= 0 || i >= len(p.tokens) {
+		return true
+	}
+	return bytes.IndexByte(p.m.src[p.tokens[i-1].end:p.tokens[i].start], '\n') >= 0
+}
+
+//
+// Offset just past a statement ending at token i, including an optional semicolon
+//
+func (p *esParser) stmtEnd(i int) (int, int) {
+	if p.is(i+1, jsPunct, ";") {
+		return p.tokens[i+1].end, i + 2
+	}
+	return p.tokens[i].end, i + 1
+}
+
+//
+// Parse an import or export ... from clause of named bindings: { a, b as c }
+//
+func (p *esParser) namedList(i int) ([]esBinding, int, bool) {
+	var list []esBinding
+	i++
+	for !p.is(i, jsPunct, "}") {
+		name, ok := p.ident(i)
+		if !ok {
+			if name, ok = p.spec(i); !ok {
+				return nil, i, false
+			}
+		}
+		local := name
+		if p.is(i+1, jsIdent, "as") {
+			if local, ok = p.ident(i + 2); !ok {
+				if local, ok = p.spec(i + 2); !ok {
+					return nil, i, false
+				}
+			}
+			i += 2
+		}
+		list = append(list, esBinding{imported: name, local: local})
+		i++
+		if p.is(i, jsPunct, ",") {
+			i++
+		}
+		if i >= len(p.tokens) {
+			return nil, i, false
+		}
+	}
+	return list, i + 1, true
+}
+
+//
+// Parse the from "x" part of a statement, skipping any import attributes
+//
+func (p *esParser) from(i int) (string, int, bool) {
+	if !p.is(i, jsIdent, "from") {
+		return "", i, false
+	}
+	spec, ok := p.spec(i + 1)
+	if !ok {
+		return "", i, false
+	}
+	i++
+	if p.is(i+1, jsIdent, "with") || p.is(i+1, jsIdent, "assert") {
+		p.m.complex = true
+	}
+	return spec, i, true
+}
+
+//
+// Parse an import statement starting at token i, returns the token after it
+//
+func (p *esParser) parseImport(i int) int {
+	start := p.tokens[i].start
+	imp := esImport{}
+
+	j := i + 1
+	if spec, ok := p.spec(j); ok {
+		// Only run for its side effects
+		imp.spec = spec
+	} else {
+		if name, ok := p.ident(j); ok && name != "from" || ok && p.is(j+1, jsIdent, "from") {
+			imp.bindings = append(imp.bindings, esBinding{imported: "default", local: name})
+			j++
+			if p.is(j, jsPunct, ",") {
+				j++
+			}
+		}
+		switch {
+		case p.is(j, jsPunct, "*"):
+			local, ok := p.ident(j + 2)
+			if !p.is(j+1, jsIdent, "as") || !ok {
+				p.m.complex = true
+				return i + 1
+			}
+			imp.bindings = append(imp.bindings, esBinding{imported: "*", local: local})
+			j += 3
+		case p.is(j, jsPunct, "{"):
+			list, next, ok := p.namedList(j)
+			if !ok {
+				p.m.complex = true
+				return i + 1
+			}
+			imp.bindings = append(imp.bindings, list...)
+			j = next
+		}
+		spec, next, ok := p.from(j)
+		if !ok {
+			p.m.complex = true
+			return i + 1
+		}
+		imp.spec = spec
+		j = next
+	}
+
+	end, next := p.stmtEnd(j)
+	p.m.imports = append(p.m.imports, imp)
+	p.m.edits = append(p.m.edits, esEdit{start: start, end: end})
+	return next
+}
+
+//
+// Parse a binding pattern in a declaration, collecting every name it binds
+//
+func (p *esParser) pattern(i int) ([]string, int, bool) {
+	if name, ok := p.ident(i); ok {
+		return []string{name}, i + 1, true
+	}
+	if i >= len(p.tokens) {
+		return nil, i, false
+	}
+
+	open := p.m.text(p.tokens[i])
+	if open != "{" && open != "[" {
+		return nil, i, false
+	}
+	close := "}"
+	if open == "[" {
+		close = "]"
+	}
+
+	var names []string
+	i++
+	for i < len(p.tokens) && !p.is(i, jsPunct, close) {
+		switch {
+		case p.is(i, jsPunct, ","):
+			i++
+			continue
+		case p.is(i, jsPunct, "."):
+			// Rest element
+			i++
+			continue
+		}
+
+		// Property name followed by its target in object patterns
+		if open == "{" && p.is(i+1, jsPunct, ":") {
+			i += 2
+		}
+		sub, next, ok := p.pattern(i)
+		if !ok {
+			return nil, i, false
+		}
+		names = append(names, sub...)
+		i = next
+		if p.is(i, jsPunct, "=") {
+			i = p.skipExpression(i + 1)
+		}
+	}
+	if i >= len(p.tokens) {
+		return nil, i, false
+	}
+	return names, i + 1, true
+}
+
+//
+// Skip an expression, stopping at a comma or the end of the statement
+//
+func (p *esParser) skipExpression(i int) int {
+	depth := 0
+	for ; i < len(p.tokens); i++ {
+		t := p.tokens[i]
+		text := p.m.text(t)
+		if t.kind == jsPunct {
+			switch text {
+			case "(", "[", "{":
+				depth++
+			case ")", "]", "}":
+				if depth == 0 {
+					return i
+				}
+				depth--
+			case ",", ";":
+				if depth == 0 {
+					return i
+				}
+			}
+			continue
+		}
+		if depth == 0 && p.newline(i) && t.kind == jsIdent && jsStatementKeywords[text] {
+			return i
+		}
+	}
+	return i
+}
+
+//
+// Parse the declarators of a const, let or var statement
+//
+func (p *esParser) declarators(i int) ([]string, int, bool) {
+	var names []string
+	for {
+		sub, next, ok := p.pattern(i)
+		if !ok {
+			return nil, i, false
+		}
+		names = append(names, sub...)
+		i = next
+		if p.is(i, jsPunct, "=") {
+			i = p.skipExpression(i + 1)
+		}
+		if !p.is(i, jsPunct, ",") {
+			return names, i, true
+		}
+		i++
+	}
+}
+
+//
+// Parse a declaration starting at token i, returning the names it declares
+//
+func (p *esParser) declaration(i int) ([]string, bool) {
+	j := i
+	if p.is(j, jsIdent, "async") {
+		j++
+	}
+	switch {
+	case p.is(j, jsIdent, "function"):
+		j++
+		if p.is(j, jsPunct, "*") {
+			j++
+		}
+		name, ok := p.ident(j)
+		return []string{name}, ok
+	case p.is(j, jsIdent, "class"):
+		name, ok := p.ident(j + 1)
+		return []string{name}, ok
+	case p.is(j, jsIdent, "const"), p.is(j, jsIdent, "let"), p.is(j, jsIdent, "var"):
+		names, _, ok := p.declarators(j + 1)
+		return names, ok
+	}
+	return nil, false
+}
+
+//
+// Parse an export statement starting at token i, returns the token after it
+//
+func (p *esParser) parseExport(i int) int {
+	start := p.tokens[i].start
+	m := p.m
+	j := i + 1
+
+	switch {
+	case p.is(j, jsIdent, "default"):
+		if j+1 >= len(p.tokens) {
+			m.complex = true
+			return i + 1
+		}
+
+		// A named declaration keeps its name, anything else gets bound to a generated one
+		k := j + 1
+		if p.is(k, jsIdent, "async") {
+			k++
+		}
+		if p.is(k, jsIdent, "function") || p.is(k, jsIdent, "class") {
+			names, ok := p.declaration(j + 1)
+			if ok && names[0] != "" && names[0] != "extends" {
+				m.edits = append(m.edits, esEdit{start: start, end: p.tokens[j+1].start})
+				m.exports = append(m.exports, esExport{name: "default", local: names[0]})
+				m.topLevel = append(m.topLevel, names[0])
+				return j + 1
+			}
+		}
+		m.edits = append(m.edits, esEdit{start: start, end: p.tokens[j+1].start, text: "var " + m.defaultID + " = "})
+		m.exports = append(m.exports, esExport{name: "default", local: m.defaultID})
+		return j + 1
+
+	case p.is(j, jsPunct, "*"):
+		k := j + 1
+		var bindings []esBinding
+		if p.is(k, jsIdent, "as") {
+			name, ok := p.ident(k + 1)
+			if !ok {
+				m.complex = true
+				return i + 1
+			}
+			bindings = []esBinding{{imported: "*", local: name}}
+			k += 2
+		}
+		spec, next, ok := p.from(k)
+		if !ok {
+			m.complex = true
+			return i + 1
+		}
+		end, after := p.stmtEnd(next)
+		m.imports = append(m.imports, esImport{spec: spec})
+		if bindings == nil {
+			m.stars = append(m.stars, len(m.imports)-1)
+		} else {
+			m.exports = append(m.exports, esExport{name: bindings[0].local, from: len(m.imports) - 1, imported: "*"})
+		}
+		m.edits = append(m.edits, esEdit{start: start, end: end})
+		return after
+
+	case p.is(j, jsPunct, "{"):
+		list, next, ok := p.namedList(j)
+		if !ok {
+			m.complex = true
+			return i + 1
+		}
+		last := next - 1
+		if spec, k, ok := p.from(next); ok {
+			// Re-exported from another module
+			m.imports = append(m.imports, esImport{spec: spec})
+			for _, b := range list {
+				m.exports = append(m.exports, esExport{name: b.local, from: len(m.imports) - 1, imported: b.imported})
+			}
+			last = k
+		} else {
+			for _, b := range list {
+				m.exports = append(m.exports, esExport{name: b.local, local: b.imported})
+			}
+		}
+		end, after := p.stmtEnd(last)
+		m.edits = append(m.edits, esEdit{start: start, end: end})
+		return after
+	}
+
+	names, ok := p.declaration(j)
+	if !ok {
+		m.complex = true
+		return i + 1
+	}
+	for _, name := range names {
+		m.exports = append(m.exports, esExport{name: name, local: name})
+	}
+	m.edits = append(m.edits, esEdit{start: start, end: p.tokens[j].start})
+	return j
+}
+
+//
+// Split a module into its imports, exports and body
+//
+func parseModule(name string, src []byte, id int) *esModule {
+	m := &esModule{name: name, src: src, refs: map[string]bool{}, defaultID: fmt.Sprintf("__hoard_default%d", id)}
+	p := &esParser{m: m, tokens: tokenizeJS(src)}
+
+	// Property names are counted too, which only ever makes hoisting more careful
+	for i, t := range p.tokens {
+		if t.kind == jsIdent && !p.is(i-1, jsPunct, ".") {
+			m.refs[m.text(t)] = true
+		}
+	}
+
+	depth := 0
+	for i := 0; i < len(p.tokens); {
+		t := p.tokens[i]
+		text := m.text(t)
+		if t.kind == jsPunct {
+			switch text {
+			case "(", "[", "{":
+				depth++
+			case ")", "]", "}":
+				depth--
+			}
+			i++
+			continue
+		}
+		if depth != 0 || t.kind != jsIdent || p.is(i-1, jsPunct, ".") {
+			i++
+			continue
+		}
+
+		switch {
+		case text == "import" && !p.is(i+1, jsPunct, "(") && !p.is(i+1, jsPunct, "."):
+			i = p.parseImport(i)
+		case text == "export":
+			i = p.parseExport(i)
+		case text == "await" && (i == 0 || p.newline(i) || p.is(i-1, jsPunct, "=")):
+			// Top level await cannot run inside a registry function
+			m.complex = true
+			i++
+		case jsStatementKeywords[text] && (text == "function" || text == "class" || text == "const" ||
+			text == "let" || text == "var" || text == "async"):
+			names, ok := p.declaration(i)
+			if !ok && text != "async" {
+				m.complex = true
+			}
+			m.topLevel = append(m.topLevel, names...)
+			i++
+		default:
+			i++
+		}
+	}
+
+	for _, e := range m.exports {
+		if e.local != "" {
+			m.topLevel = append(m.topLevel, e.local)
+		}
+	}
+	return m
+}
+
+//
+// The body of a module with its import and export syntax removed
+//
+func (m *esModule) body() []byte {
+	sort.Slice(m.edits, func(i, j int) bool { return m.edits[i].start < m.edits[j].start })
+
+	var out bytes.Buffer
+	last := 0
+	for _, e := range m.edits {
+		if e.start < last {
+			continue
+		}
+		out.Write(m.src[last:e.start])
+		out.WriteString(e.text)
+		last = e.end
+	}
+	out.Write(m.src[last:])
+	return out.Bytes()
+}
+
+//
+// A graph of modules reachable from an entry point, in dependency order
+//
+type moduleGraph struct {
+	hh      *HoardHandler
+	modules map[string]*esModule
+	order   []string
+	cyclic  bool
+	deps    []string          // Extra files found while rewriting, such as dynamic imports
+	links   map[string]string // URLs of files linked from the modules, see TransformContext
+}
+
+//
+// Keep what a transform of one of the modules depended on
+//
+func (g *moduleGraph) addInputs(tc *TransformContext) {
+	g.deps = append(g.deps, tc.deps...)
+	for name, url := range tc.links {
+		if g.links == nil {
+			g.links = make(map[string]string)
+		}
+		g.links[name] = url
+	}
+}
+
+//
+// Load a module and everything it imports, depth first so dependencies come first
+//
+func (g *moduleGraph) load(name string, visiting map[string]bool) error {
+	if visiting[name] {
+		g.cyclic = true
+		return nil
+	}
+	if _, ok := g.modules[name]; ok {
+		return nil
+	}
+
+	f, err := g.hh.Dir.Open(name)
+	if err != nil {
+		return err
+	}
+	src, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	// Imports are followed here and the bundle is minified as a whole, every other
+	// stage of the pipeline runs on each module
+	ctype := mime.TypeByExtension(path.Ext(name))
+	stages := []Transformer{}
+	for _, t := range g.hh.pipeline(ctype) {
+		if t != RewriteJSImports && t != Minifier {
+			stages = append(stages, t)
+		}
+	}
+	src, stc, err := g.hh.runStages(name, ctype, src, stages)
+	if err != nil {
+		return err
+	}
+	g.addInputs(stc)
+
+	m := parseModule(name, src, len(g.modules))
+	g.modules[name] = m
+	visiting[name] = true
+
+	tc := &TransformContext{Hoard: g.hh, Name: name}
+	for i, imp := range m.imports {
+		if isExternalURL(imp.spec) || !strings.HasPrefix(imp.spec, "./") && !strings.HasPrefix(imp.spec, "../") &&
+			!strings.HasPrefix(imp.spec, g.hh.Prefix) {
+			continue
+		}
+		file, _ := splitRef(imp.spec)
+		dep, ok := tc.resolveName(file)
+		if !ok {
+			continue
+		}
+		m.imports[i].dep = dep
+		if err := g.load(dep, visiting); err != nil {
+			return fmt.Errorf("%s imported from %s: %v", dep, name, err)
+		}
+	}
+
+	delete(visiting, name)
+	g.order = append(g.order, name)
+	return nil
+}
+
+//
+// Find the module and local binding an export of a module ends up at, following re-exports
+//
+func (g *moduleGraph) resolveExport(name, export string, seen map[string]bool) (string, string, bool) {
+	m := g.modules[name]
+	if m == nil || seen[name] {
+		return "", "", false
+	}
+	seen[name] = true
+
+	for _, e := range m.exports {
+		if e.name != export {
+			continue
+		}
+		if e.local != "" {
+			return name, e.local, true
+		}
+		imp := m.imports[e.from]
+		if imp.dep == "" || e.imported == "*" {
+			return "", "", false
+		}
+		return g.resolveExport(imp.dep, e.imported, seen)
+	}
+	return "", "", false
+}
+
+//
+// Check if the modules can share one scope: no cycles, no namespace objects, every
+// name declared once, every import bound to the same name it is declared with and
+// no module using a global of the same name as another module's declaration
+//
+func (g *moduleGraph) hoistable() bool {
+	if g.cyclic {
+		return false
+	}
+
+	declared := map[string]string{}
+	external := map[string]string{}
+	for _, name := range g.order {
+		m := g.modules[name]
+		if m.complex || len(m.stars) > 0 {
+			return false
+		}
+		for _, top := range m.topLevel {
+			if owner, ok := declared[top]; ok && owner != name {
+				return false
+			}
+			declared[top] = name
+		}
+		for _, e := range m.exports {
+			if e.imported == "*" {
+				return false
+			}
+		}
+		for _, imp := range m.imports {
+			for _, b := range imp.bindings {
+				if imp.dep == "" {
+					key := imp.spec + "\x00" + b.imported
+					if prev, ok := external[b.local]; ok && prev != key {
+						return false
+					}
+					external[b.local] = key
+					continue
+				}
+				if b.imported == "*" {
+					return false
+				}
+				_, local, ok := g.resolveExport(imp.dep, b.imported, map[string]bool{})
+				if !ok || local != b.local {
+					return false
+				}
+			}
+		}
+	}
+
+	for local := range external {
+		if _, ok := declared[local]; ok {
+			return false
+		}
+	}
+
+	// A name a module uses without declaring or importing it is a global, which would
+	// end up meaning another module's declaration. Names bound in nested scopes are
+	// not told apart, so those are treated the same way to be safe.
+	for _, name := range g.order {
+		m := g.modules[name]
+		own := map[string]bool{}
+		for _, top := range m.topLevel {
+			own[top] = true
+		}
+		for _, imp := range m.imports {
+			for _, b := range imp.bindings {
+				own[b.local] = true
+			}
+		}
+		for ref := range m.refs {
+			if own[ref] {
+				continue
+			}
+			if _, ok := declared[ref]; ok {
+				return false
+			}
+			if _, ok := external[ref]; ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+//
+// Import statements for everything outside the bundle, the same in both output formats
+// apart from how the bindings are named
+//
+func (g *moduleGraph) externalImports(out *bytes.Buffer, hoisted bool) map[string]string {
+	namespaces := map[string]string{}
+	seen := map[string]bool{}
+	for _, name := range g.order {
+		for _, imp := range g.modules[name].imports {
+			if imp.dep != "" {
+				continue
+			}
+			if !hoisted {
+				if _, ok := namespaces[imp.spec]; !ok {
+					namespaces[imp.spec] = fmt.Sprintf("__hoard_ext%d", len(namespaces))
+					fmt.Fprintf(out, "import * as %s from %q;\n", namespaces[imp.spec], imp.spec)
+				}
+				continue
+			}
+			if len(imp.bindings) == 0 {
+				if !seen[imp.spec] {
+					fmt.Fprintf(out, "import %q;\n", imp.spec)
+					seen[imp.spec] = true
+				}
+				continue
+			}
+			for _, b := range imp.bindings {
+				key := imp.spec + "\x00" + b.local
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+				switch b.imported {
+				case "*":
+					fmt.Fprintf(out, "import * as %s from %q;\n", b.local, imp.spec)
+				case "default":
+					fmt.Fprintf(out, "import %s from %q;\n", b.local, imp.spec)
+				default:
+					fmt.Fprintf(out, "import { %s as %s } from %q;\n", b.imported, b.local, imp.spec)
+				}
+			}
+		}
+	}
+	return namespaces
+}
+
+//
+// Rewrite dynamic imports left in a module body, relative to where the module lives
+//
+func (g *moduleGraph) rewriteBody(name string, body []byte) []byte {
+	tc := &TransformContext{Hoard: g.hh, Name: name}
+	out, _ := RewriteJSImports.Transform(tc, body)
+	g.addInputs(tc)
+	return out
+}
+
+//
+// Concatenate the modules into one scope, in dependency order
+//
+func (g *moduleGraph) hoist() []byte {
+	var out bytes.Buffer
+	g.externalImports(&out, true)
+	for _, name := range g.order {
+		fmt.Fprintf(&out, "\n// %s\n", name)
+		out.Write(g.rewriteBody(name, g.modules[name].body()))
+		out.WriteString("\n;\n")
+	}
+	return out.Bytes()
+}
+
+//
+// Wrap every module in a function registered under its name, evaluated on first require
+//
+func (g *moduleGraph) registry() ([]byte, error) {
+	var out bytes.Buffer
+	namespaces := g.externalImports(&out, false)
+
+	out.WriteString("var __hoard_modules = {}, __hoard_cache = {};\n")
+	out.WriteString("function __hoard_require(id) {\n" +
+		"\tvar m = __hoard_cache[id];\n" +
+		"\tif (m) return m.exports;\n" +
+		"\tm = __hoard_cache[id] = { exports: {} };\n" +
+		"\t__hoard_modules[id](m.exports, __hoard_require);\n" +
+		"\treturn m.exports;\n" +
+		"}\n")
+
+	for _, name := range g.order {
+		m := g.modules[name]
+		fmt.Fprintf(&out, "\n__hoard_modules[%q] = function (__exports, __require) {\n", name)
+
+		// Exports are getters so importers see later assignments
+		for _, e := range m.exports {
+			getter := e.local
+			if ref, ok := importRef(m, namespaces, e.local); ok {
+				getter = ref
+			}
+			if getter == "" {
+				imp := m.imports[e.from]
+				getter = fmt.Sprintf("__require(%q)", imp.dep)
+				if imp.dep == "" {
+					getter = namespaces[imp.spec]
+				}
+				if e.imported != "*" {
+					getter = fmt.Sprintf("%s[%q]", getter, e.imported)
+				}
+			}
+			fmt.Fprintf(&out, "\tObject.defineProperty(__exports, %q, { enumerable: true, get: function () { return %s; } });\n", e.name, getter)
+		}
+		for _, idx := range m.stars {
+			imp := m.imports[idx]
+			source := fmt.Sprintf("__require(%q)", imp.dep)
+			if imp.dep == "" {
+				source = namespaces[imp.spec]
+			}
+			fmt.Fprintf(&out, "\t(function (s) { Object.keys(s).forEach(function (k) { if (k !== \"default\" && !(k in __exports)) "+
+				"Object.defineProperty(__exports, k, { enumerable: true, get: function () { return s[k]; } }); }); })(%s);\n", source)
+		}
+
+		// Imports are required in the order they appear, which runs dependencies
+		// first. Uses of imported names read through the exports object of the
+		// other module so they stay live, as in a real module.
+		refs := map[string]string{}
+		for i, imp := range m.imports {
+			source := namespaces[imp.spec]
+			if imp.dep != "" {
+				source = fmt.Sprintf("__hoard_i%d", i)
+				fmt.Fprintf(&out, "	const %s = __require(%q);\n", source, imp.dep)
+			}
+			for _, b := range imp.bindings {
+				if b.imported == "*" {
+					refs[b.local] = source
+				} else {
+					refs[b.local] = fmt.Sprintf("%s[%q]", source, b.imported)
+				}
+			}
+		}
+
+		body, err := renameJSIdents(g.rewriteBody(name, m.body()), refs)
+		if err != nil {
+			return nil, fmt.Errorf("hoard: cannot bundle %s: %v", name, err)
+		}
+		out.Write(body)
+		out.WriteString("\n};\n")
+	}
+
+	fmt.Fprintf(&out, "\n__hoard_require(%q);\n", g.order[len(g.order)-1])
+	return out.Bytes(), nil
+}
+
+//
+// The expression reading an imported binding of a module in the registry
+//
+func importRef(m *esModule, namespaces map[string]string, local string) (string, bool) {
+	for i, imp := range m.imports {
+		source := namespaces[imp.spec]
+		if imp.dep != "" {
+			source = fmt.Sprintf("__hoard_i%d", i)
+		}
+		for _, b := range imp.bindings {
+			if b.local != local || local == "" {
+				continue
+			}
+			if b.imported == "*" {
+				return source, true
+			}
+			return fmt.Sprintf("%s[%q]", source, b.imported), true
+		}
+	}
+	return "", false
+}
+
+// What an open bracket starts, for renameJSIdents
+const (
+	jsGroup   = iota // Parentheses or brackets around an expression
+	jsBlock          // Block of statements
+	jsObject         // Object literal
+	jsClass          // Class body
+	jsParams         // Parameter list of a function
+	jsPattern        // Destructuring pattern binding names
+)
+
+// Tokens that can come just before the name of a class member
+var jsMemberPrefixes = map[string]bool{
+	"{": true, "}": true, ";": true, "static": true, "get": true, "set": true, "async": true, "*": true, "accessor": true,
+}
+
+//
+// Replace uses of names in JS with expressions. Property names, object keys and
+// class members are left alone, shorthand properties get expanded. Nested scopes
+// are not tracked, so a name that is bound again in one, such as by a parameter
+// or a local variable, is an error rather than being renamed along with the rest.
+//
+func renameJSIdents(src []byte, refs map[string]string) ([]byte, error) {
+	if len(refs) == 0 {
+		return src, nil
+	}
+
+	tokens := tokenizeJS(src)
+	text := func(i int) string {
+		if i < 0 || i >= len(tokens) {
+			return ""
+		}
+		return string(src[tokens[i].start:tokens[i].end])
+	}
+	newline := func(i int) bool {
+		return i > 0 && i < len(tokens) && bytes.IndexByte(src[tokens[i-1].end:tokens[i].start], '\n') >= 0
+	}
+
+	// Find the closing bracket of each opening one, to tell arrow function parameters
+	closing := make([]int, len(tokens))
+	var open []int
+	for i := range tokens {
+		switch text(i) {
+		case "(", "[", "{":
+			open = append(open, i)
+		case ")", "]", "}":
+			if len(open) > 0 {
+				closing[open[len(open)-1]] = i
+				open = open[:len(open)-1]
+			}
+		}
+	}
+	isArrow := func(i int) bool {
+		return text(i) == "=" && text(i+1) == ">" && tokens[i].end == tokens[i+1].start
+	}
+
+	var out bytes.Buffer
+	var kinds []int // What each open bracket starts
+	top := func() int {
+		if len(kinds) == 0 {
+			return jsBlock
+		}
+		return kinds[len(kinds)-1]
+	}
+	inPattern := func() bool { return top() == jsParams || top() == jsPattern }
+
+	// Check if the name at i is a key or method name of the object or class it is in
+	memberName := func(i int) bool {
+		if i <= 0 || tokens[i].kind != jsIdent {
+			return false
+		}
+		prev := text(i - 1)
+		switch top() {
+		case jsObject:
+			if prev == "get" || prev == "set" || prev == "async" || prev == "*" {
+				prev = text(i - 2)
+			}
+			return prev == "{" || prev == ","
+		case jsClass:
+			return jsMemberPrefixes[prev] || newline(i) && (tokens[i-1].kind != jsPunct || prev == ")" || prev == "]")
+		}
+		return false
+	}
+	classAt := -1 // Bracket depth of a class whose body has not started yet
+	declAt := -1  // Bracket depth of a var, let or const statement
+	last := 0
+	for i, t := range tokens {
+		prev, next := text(i-1), text(i+1)
+		switch text(i) {
+		case "(":
+			kind := jsGroup
+			p := i - 1
+			if p >= 0 && tokens[p].kind == jsIdent && text(p) != "function" {
+				p--
+			}
+			if text(p) == "*" {
+				p--
+			}
+			if text(p) == "function" || prev == "catch" || closing[i] > i && isArrow(closing[i]+1) || memberName(i-1) {
+				kind = jsParams
+			}
+			kinds = append(kinds, kind)
+			continue
+		case "[", "{":
+			kind := jsGroup
+			switch {
+			case text(i) == "{" && classAt == len(kinds):
+				kind = jsClass
+				classAt = -1
+			case prev == "var" || prev == "let" || prev == "const" || declAt == len(kinds) && prev == ",":
+				kind = jsPattern
+			case inPattern() && (prev == "(" || prev == "," || prev == ":" || prev == "{" || prev == "[" || prev == "."):
+				kind = jsPattern
+			case text(i) == "{" && (strings.Contains("(,=:[?", prev) && prev != "" || prev == "return"):
+				kind = jsObject
+			case text(i) == "{":
+				kind = jsBlock
+			}
+			kinds = append(kinds, kind)
+			continue
+		case ")", "]", "}":
+			if len(kinds) > 0 {
+				kinds = kinds[:len(kinds)-1]
+			}
+			if declAt > len(kinds) {
+				declAt = -1
+			}
+			continue
+		case ";":
+			if declAt == len(kinds) {
+				declAt = -1
+			}
+			continue
+		case "class":
+			if prev != "." {
+				classAt = len(kinds)
+			}
+		case "var", "let", "const":
+			if prev != "." {
+				declAt = len(kinds)
+			}
+		}
+		if t.kind != jsIdent {
+			continue
+		}
+		name := text(i)
+		ref, ok := refs[name]
+		if !ok || prev == "." || prev == "#" {
+			continue
+		}
+
+		// Names of class members
+		if top() == jsClass && memberName(i) {
+			continue
+		}
+
+		// Bindings of the same name in a nested scope
+		binding := false
+		switch {
+		case prev == "var" || prev == "let" || prev == "const" || prev == "function" || prev == "class" || prev == "*" && text(i-2) == "function":
+			binding = true
+		case declAt == len(kinds) && prev == ",":
+			binding = true
+		case isArrow(i + 1):
+			binding = true
+		case top() == jsPattern && (prev == "{" || prev == ",") && next == ":":
+			// Property name in an object pattern
+			continue
+		case inPattern() && (prev == "(" || prev == "," || prev == "." || prev == "{" || prev == "[" || prev == ":"):
+			binding = true
+		}
+		if binding {
+			return nil, fmt.Errorf("%s is also bound in a nested scope, where it cannot be told apart from the import", name)
+		}
+
+		// Object keys, methods and shorthand properties
+		keyPosition := top() == jsObject && memberName(i)
+		if keyPosition && (next == ":" || next == "(" || prev != "{" && prev != ",") {
+			continue
+		}
+
+		out.Write(src[last:t.start])
+		if keyPosition && (next == "," || next == "}") {
+			out.WriteString(name + ": ")
+		}
+		out.WriteString(ref)
+		last = t.end
+	}
+
+	if last == 0 {
+		return src, nil
+	}
+	out.Write(src[last:])
+	return out.Bytes(), nil
+}
+
+//
+// A bundle built from a module entry point
+//
+type moduleBundle struct {
+	fb  *FileBuffer
+	url string
+}
+
+//
+// Bundle an entry module and everything it imports into one file, returns its URL
+//
+func (hh *HoardHandler) bundleModule(entry string) (string, error) {
+	if mb, ok := hh.modules[entry]; ok && !mb.fb.depsModified() {
+		return mb.url, nil
+	}
+
+	built := hh.building(entry)
+	g := &moduleGraph{hh: hh, modules: make(map[string]*esModule)}
+	if err := g.load(entry, map[string]bool{}); err != nil {
+		hh.reportError(entry, err)
+		return "", err
+	}
+
+	var buf []byte
+	if g.hoistable() {
+		buf = g.hoist()
+	} else {
+		var err error
+		if buf, err = g.registry(); err != nil {
+			hh.reportError(entry, err)
+			return "", err
+		}
+	}
+
+	// Only the minifier runs on the bundle, the other stages ran on each module
+	if hh.minifies("text/javascript") {
+		minified, err := hh.minify("text/javascript", buf)
+		if err != nil {
+			hh.reportError(entry, err)
+			if hh.Strict {
+				return "", err
+			}
+		} else {
+			buf = minified
+		}
+	}
+
+	fb := &FileBuffer{
+		parent: hh,
+		mod:    0,
+		files:  make(map[string]int64),
+		links:  g.links,
+		buf:    buf,
+		body:   buf,
+	}
+	for _, name := range append(g.order, g.deps...) {
+		fb.files[name] = hh.modTime(name)
+	}
+
+	fb.computeIntegrity()
+
+	fb.hashName = fmt.Sprintf("%x.js", md5.Sum(buf))
+	last, rebuilt := hh.modules[entry]
+	hh.Stashed[fb.hashName] = fb
+	hh.modules[entry] = moduleBundle{fb: fb, url: hh.Prefix + fb.hashName}
+	if rebuilt {
+		hh.dropBuild(last.fb)
+	}
+	built()
+	return hh.Prefix + fb.hashName, nil
+}
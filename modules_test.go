@@ -0,0 +1,255 @@
+package hoard
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestParseModule(t *testing.T) {
+	tests := []struct {
+		name     string
+		src      string
+		imports  []string // Specifiers, in order
+		exports  []string // Exported name=local binding, or name<-imported for re-exports
+		topLevel []string // Sorted, each name once
+		complex  bool
+	}{
+		{
+			name:     "named imports",
+			src:      "import { a, b as c } from './x.js'\nconsole.log(a, c)",
+			imports:  []string{"./x.js"},
+			topLevel: nil,
+		},
+		{
+			name:     "declarations",
+			src:      "export const d = 1, { e, f: [g] } = o\nexport function h() {}\nexport class K {}\nlet hidden",
+			exports:  []string{"d=d", "e=e", "g=g", "h=h", "K=K"},
+			topLevel: []string{"K", "d", "e", "g", "h", "hidden"},
+		},
+		{
+			name:     "named default",
+			src:      "export default function main() {}",
+			exports:  []string{"default=main"},
+			topLevel: []string{"main"},
+		},
+		{
+			name:     "anonymous default",
+			src:      "export default 42",
+			exports:  []string{"default=__hoard_default0"},
+			topLevel: []string{"__hoard_default0"},
+		},
+		{
+			name:     "export list",
+			src:      "const a = 1\nexport { a as b }",
+			exports:  []string{"b=a"},
+			topLevel: []string{"a"},
+		},
+		{
+			name:    "re-exports",
+			src:     "export { x as y } from './r.js'\nexport * from './s.js'",
+			imports: []string{"./r.js", "./s.js"},
+			exports: []string{"y<-x"},
+		},
+		{
+			name:     "nested declarations are not top level",
+			src:      "function f() { const inner = 1 }\nif (x) { let alsoInner }",
+			topLevel: []string{"f"},
+		},
+		{
+			name:     "top level await",
+			src:      "const data = 1\nawait load(data)",
+			topLevel: []string{"data"},
+			complex:  true,
+		},
+		{
+			name:    "import attributes",
+			src:     "import cfg from './c.json' with { type: 'json' }",
+			imports: []string{"./c.json"},
+			complex: true,
+		},
+		{
+			name:    "truncated declaration",
+			src:     "export const",
+			complex: true,
+		},
+		{
+			name:    "truncated default export",
+			src:     "export default",
+			complex: true,
+		},
+		{
+			name:    "truncated pattern",
+			src:     "const { a",
+			complex: true,
+		},
+	}
+	for _, tt := range tests {
+		m := parseModule("x.js", []byte(tt.src), 0)
+
+		var imports, exports []string
+		for _, imp := range m.imports {
+			imports = append(imports, imp.spec)
+		}
+		for _, e := range m.exports {
+			if e.local != "" {
+				exports = append(exports, e.name+"="+e.local)
+			} else {
+				exports = append(exports, e.name+"<-"+e.imported)
+			}
+		}
+		var topLevel []string
+		seen := map[string]bool{}
+		for _, name := range m.topLevel {
+			if !seen[name] {
+				seen[name] = true
+				topLevel = append(topLevel, name)
+			}
+		}
+		sort.Strings(topLevel)
+
+		if !reflect.DeepEqual(imports, tt.imports) {
+			t.Errorf("%s: imports %q, want %q", tt.name, imports, tt.imports)
+		}
+		if !reflect.DeepEqual(exports, tt.exports) {
+			t.Errorf("%s: exports %q, want %q", tt.name, exports, tt.exports)
+		}
+		if !reflect.DeepEqual(topLevel, tt.topLevel) {
+			t.Errorf("%s: top level %q, want %q", tt.name, topLevel, tt.topLevel)
+		}
+		if m.complex != tt.complex {
+			t.Errorf("%s: complex %v, want %v", tt.name, m.complex, tt.complex)
+		}
+	}
+}
+
+func TestRenameJSIdents(t *testing.T) {
+	refs := map[string]string{"render": `i["render"]`, "ns": "n"}
+	tests := []struct {
+		name string
+		src  string
+		want string // Empty if the name is bound again and it has to fail
+	}{
+		{"uses", "render(ns.render, render)", `i["render"](n.render, i["render"])`},
+		{"property access", "o.render = render; o?.render", `o.render = i["render"]; o?.render`},
+		{"object keys", "({ render: render, [render]: 1 })", `({ render: i["render"], [i["render"]]: 1 })`},
+		{"shorthand property", "({ a, render })", `({ a, render: i["render"] })`},
+		{"object methods", "({ render() { render() }, get render() { return render } })", `({ render() { i["render"]() }, get render() { return i["render"] } })`},
+		{"class members", "class A { render() { render() } static render = render\n#render = 1; x = 1\nrender() {} }", "class A { render() { i[\"render\"]() } static render = i[\"render\"]\n#render = 1; x = 1\nrender() {} }"},
+		{"default parameter", "(a = render) => a + render", `(a = i["render"]) => a + i["render"]`},
+		{"pattern key", "const { render: x } = ns", `const { render: x } = n`},
+		{"nested blocks", "if (x) { render(ns) } else { const y = [render] }", `if (x) { i["render"](n) } else { const y = [i["render"]] }`},
+		{"callbacks", "x.map(function (y) { return render(y) })", `x.map(function (y) { return i["render"](y) })`},
+		{"parameter", "function show(render) { return render }", ""},
+		{"arrow parameter", "const f = (a, render) => a", ""},
+		{"bare arrow parameter", "const f = render => 1", ""},
+		{"destructured parameter", "function f({ render }) {}", ""},
+		{"local variable", "function f() { let a = 1, render = 2 }", ""},
+		{"local pattern", "{ const { x: render } = ns }", ""},
+		{"loop variable", "for (const render of ns) {}", ""},
+		{"catch parameter", "try {} catch (render) {}", ""},
+		{"local function", "{ function render() {} }", ""},
+	}
+	for _, tt := range tests {
+		out, err := renameJSIdents([]byte(tt.src), refs)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%s: renamed to %s, want an error", tt.name, out)
+			}
+			continue
+		}
+		if err != nil || string(out) != tt.want {
+			t.Errorf("%s: got %s %v, want %s", tt.name, out, err, tt.want)
+		}
+	}
+}
+
+func TestModuleRegistry(t *testing.T) {
+	hh := testHoard(t, "/module-registry/", map[string]string{
+		// The namespace import means the modules cannot share one scope
+		"main.js": `import * as ns from "./lib.js"
+import { render } from "./view.js"
+class App { render() { return render(ns.x) } }
+const o = { render() { return render } }
+console.log(new App().render(), o.render() === render)`,
+		"lib.js":  `export const x = 1`,
+		"view.js": `export function render(v) { return v }`,
+		"shadow.js": `import * as ns from "./lib.js"
+import { render } from "./view.js"
+export function show(render) { return render(ns.x) }`,
+	})
+
+	url, err := hh.bundleModule("main.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := hh.Stashed[hh.RemovePrefix(url)].buf
+	for _, want := range []string{"class App { render() { return __hoard_i1[\"render\"](__hoard_i0.x) } }", "const o = { render() { return __hoard_i1[\"render\"] } }"} {
+		if !bytes.Contains(buf, []byte(want)) {
+			t.Errorf("bundle does not contain %s:\n%s", want, buf)
+		}
+	}
+
+	// Run the bundle if there is a way to
+	if node, err := exec.LookPath("node"); err == nil {
+		dir, err := ioutil.TempDir("", "hoard")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		file := filepath.Join(dir, "bundle.mjs")
+		if err := ioutil.WriteFile(file, buf, 0644); err != nil {
+			t.Fatal(err)
+		}
+		out, err := exec.Command(node, file).CombinedOutput()
+		if err != nil || string(out) != "1 true\n" {
+			t.Errorf("running the bundle: %s %v", out, err)
+		}
+	}
+
+	if _, err := hh.bundleModule("shadow.js"); err == nil || !strings.Contains(err.Error(), "render") {
+		t.Errorf("bundling a module with a shadowed import: got %v, want an error naming it", err)
+	}
+}
+
+func TestModuleBundleRebuild(t *testing.T) {
+	hh := testHoard(t, "/module-rebuild/", map[string]string{
+		"main.js": `import { x } from "./lib.js"; console.log(x)`,
+		"lib.js":  `export const x = 0`,
+	})
+
+	first, err := hh.bundleModule("main.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stashed := len(hh.Stashed)
+
+	// Edits within the same second as the build are only noticed through invalidate
+	url := first
+	for i := 1; i <= 3; i++ {
+		writeTestFile(t, string(hh.Dir), "lib.js", fmt.Sprintf("export const x = %d", i))
+		hh.invalidate([]string{"lib.js"})
+		next, err := hh.bundleModule("main.js")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if next == url {
+			t.Fatalf("edit %d left the bundle at %s", i, url)
+		}
+		url = next
+	}
+
+	if _, ok := hh.Stashed[hh.RemovePrefix(first)]; ok {
+		t.Error("the first build is still stashed")
+	}
+	if len(hh.Stashed) != stashed {
+		t.Errorf("%d files stashed after rebuilding, want %d", len(hh.Stashed), stashed)
+	}
+}
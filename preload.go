@@ -0,0 +1,271 @@
+package hoard
+
+import (
+	"bytes"
+	"container/list"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Extensions of files preloaded as fonts, the mime tables rarely know them
+var fontExts = map[string]bool{".woff2": true, ".woff": true, ".ttf": true, ".otf": true, ".eot": true}
+
+//
+// A file the page needs, as it goes in a Link header
+//
+type preloadLink struct {
+	url  string
+	as   string // Destination, empty for module preloads
+	cors bool   // Fetched in cors mode, the preload has to match or it is wasted
+}
+
+func (pl preloadLink) String() string {
+	if pl.as == "" {
+		return "<" + pl.url + ">; rel=modulepreload"
+	}
+	link := "<" + pl.url + ">; rel=preload; as=" + pl.as
+	if pl.cors {
+		link += "; crossorigin"
+	}
+	return link
+}
+
+//
+// Find what a file is preloaded as from its name, empty if it should not be
+//
+func preloadAs(name string) string {
+	ext := strings.ToLower(path.Ext(name))
+	if fontExts[ext] {
+		return "font"
+	}
+	mediatype := mediaType(mime.TypeByExtension(ext))
+	switch {
+	case mediatype == "text/css":
+		return "style"
+	case strings.HasSuffix(mediatype, "javascript"):
+		return "script"
+	case strings.HasPrefix(mediatype, "image/"):
+		return "image"
+	}
+	return ""
+}
+
+//
+// Record a URL hoard resolved during the render, along with any fonts the file
+// pulls in. Modules are preloaded as such so the fetch matches the script tag.
+//
+func (st *renderState) collect(url string, fb *FileBuffer, module bool) {
+	if st == nil {
+		return
+	}
+
+	// Tags with integrity get a crossorigin attribute
+	links := []preloadLink{{url: url, as: preloadAs(url), cors: fb != nil && fb.integrity != ""}}
+	if module {
+		links[0].as = ""
+	} else if links[0].as == "" {
+		return
+	}
+
+	// Fonts referenced from stylesheets are only found once the CSS is parsed, and
+	// are always fetched in cors mode
+	if fb != nil && links[0].as == "style" {
+		members := fb.deps
+		if len(members) == 0 {
+			members = []*FileBuffer{fb}
+		}
+		for _, m := range members {
+			for name := range m.files {
+				if !fontExts[strings.ToLower(path.Ext(name))] {
+					continue
+				}
+				if hashed, err := addResource(name, m.parent); err == nil {
+					links = append(links, preloadLink{url: hashed, as: "font", cors: true})
+				}
+			}
+		}
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for _, l := range links {
+		dup := false
+		for _, seen := range st.assets {
+			if seen.url == l.url {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			st.assets = append(st.assets, l)
+		}
+	}
+}
+
+//
+// Link header values for every asset collected so far
+//
+func (st *renderState) links() []string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	links := make([]string, len(st.assets))
+	for i, l := range st.assets {
+		links[i] = l.String()
+	}
+	return links
+}
+
+// Paths early hints are remembered for, the least recently rendered are forgotten first
+const maxEarlyHints = 1024
+
+// Links sent with the last successful render of each path, for early hints
+var earlyHints = &hintCache{entries: map[string]*list.Element{}, order: list.New()}
+
+//
+// Links by path, holding at most maxEarlyHints paths
+//
+type hintCache struct {
+	sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // Most recently rendered path at the front
+}
+
+type hintEntry struct {
+	path  string
+	links []string
+}
+
+func (hc *hintCache) get(path string) []string {
+	hc.Lock()
+	defer hc.Unlock()
+	if e, ok := hc.entries[path]; ok {
+		return e.Value.(*hintEntry).links
+	}
+	return nil
+}
+
+//
+// Remember the links of a path, forgetting it if there are none
+//
+func (hc *hintCache) put(path string, links []string) {
+	hc.Lock()
+	defer hc.Unlock()
+	if e, ok := hc.entries[path]; ok {
+		if len(links) == 0 {
+			hc.order.Remove(e)
+			delete(hc.entries, path)
+			return
+		}
+		e.Value.(*hintEntry).links = links
+		hc.order.MoveToFront(e)
+		return
+	}
+	if len(links) == 0 {
+		return
+	}
+
+	hc.entries[path] = hc.order.PushFront(&hintEntry{path: path, links: links})
+	for hc.order.Len() > maxEarlyHints {
+		oldest := hc.order.Back()
+		hc.order.Remove(oldest)
+		delete(hc.entries, oldest.Value.(*hintEntry).path)
+	}
+}
+
+//
+// Response held back until the page is rendered, so headers can still be added
+//
+type bufferedResponse struct {
+	http.ResponseWriter
+	status int
+	buf    bytes.Buffer
+}
+
+func (br *bufferedResponse) WriteHeader(status int) {
+	if br.status == 0 && status >= 200 {
+		br.status = status
+	}
+}
+
+func (br *bufferedResponse) Write(b []byte) (int, error) {
+	if br.status == 0 {
+		br.status = http.StatusOK
+	}
+	return br.buf.Write(b)
+}
+
+//
+// Fill in the tags for files the page required
+//
+func (br *bufferedResponse) render(st *renderState) error {
+	page, err := st.renderRequired(br.buf.Bytes())
+	if err != nil {
+		return err
+	}
+	if len(page) != br.buf.Len() {
+		br.Header().Del("Content-Length")
+	}
+	br.buf.Reset()
+	br.buf.Write(page)
+	return nil
+}
+
+//
+// Write out the held back response
+//
+func (br *bufferedResponse) send() {
+	if br.status == 0 {
+		br.status = http.StatusOK
+	}
+	br.ResponseWriter.WriteHeader(br.status)
+	br.ResponseWriter.Write(br.buf.Bytes())
+}
+
+//
+// Middleware adding a Link preload header for every stylesheet, script and font
+// hoard resolves while the page renders, and filling in hoard_head and
+// hoard_footer. Templates have to use the functions from FuncsContext with the
+// request's context. Responses are buffered until the handler returns. When a
+// path has been rendered before, its links are also sent straight away in a 103
+// Early Hints response. Only the path is used, the client picks the host.
+//
+func PreloadHints(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, st := withState(r.Context())
+		key := r.URL.Path
+
+		// Interim responses are not understood by HTTP/1.0 clients
+		if r.Method == http.MethodGet && r.ProtoAtLeast(1, 1) {
+			if previous := earlyHints.get(key); len(previous) > 0 {
+				for _, l := range previous {
+					w.Header().Add("Link", l)
+				}
+				w.WriteHeader(http.StatusEarlyHints)
+				w.Header().Del("Link")
+			}
+		}
+
+		br := &bufferedResponse{ResponseWriter: w}
+		next.ServeHTTP(br, r.WithContext(ctx))
+		if err := br.render(st); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if br.status == 0 {
+			br.status = http.StatusOK
+		}
+
+		links := st.links()
+		for _, l := range links {
+			w.Header().Add("Link", l)
+		}
+		if r.Method == http.MethodGet && br.status == http.StatusOK {
+			earlyHints.put(key, links)
+		}
+
+		br.send()
+	})
+}
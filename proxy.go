@@ -0,0 +1,70 @@
+package hoard
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+)
+
+//
+// Pass requests the hoard can serve neither from its stash nor from its directory
+// on to a development server, such as one run by Vite or esbuild. Names matching
+// the given patterns, with or without the hoard's prefix, are always left to it,
+// and templates point straight at them. Both only happen in development mode.
+// Paths under the prefix map to the same paths under the upstream URL.
+//
+func (hh *HoardHandler) DevProxy(upstream string, names ...string) error {
+	target, err := url.Parse(upstream)
+	if err != nil {
+		return fmt.Errorf("hoard: development server %s: %v", upstream, err)
+	}
+	if target.Scheme == "" || target.Host == "" {
+		return fmt.Errorf("hoard: development server %s needs a scheme and a host", upstream)
+	}
+
+	defer lockStash()()
+
+	patterns := make([]string, len(names))
+	for i, name := range names {
+		patterns[i] = strings.TrimPrefix(name, hh.Prefix)
+	}
+	hh.proxied = patterns
+	hh.proxy = &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			r.URL.Scheme = target.Scheme
+			r.URL.Host = target.Host
+			r.URL.Path = strings.TrimSuffix(target.Path, "/") + "/" + strings.TrimPrefix(r.URL.Path, hh.Prefix)
+			r.URL.RawPath = ""
+			r.Host = target.Host
+		},
+	}
+	return nil
+}
+
+//
+// Check if a name under the hoard is left to the development server
+//
+func (hh *HoardHandler) proxies(name string) bool {
+	if !hh.Dev || hh.proxy == nil {
+		return false
+	}
+	for _, pattern := range hh.proxied {
+		if matchGlob(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// Find the hoard a file belongs to if the development server serves it in its place
+//
+func proxied(in string) (*HoardHandler, bool) {
+	hh := hoardOf(in)
+	if hh == nil || !hh.proxies(hh.RemovePrefix(in)) {
+		return nil, false
+	}
+	return hh, true
+}
@@ -0,0 +1,132 @@
+package hoard
+
+import (
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// A development server recording the paths it was asked for
+type upstream struct {
+	mu    sync.Mutex
+	paths []string
+}
+
+func (u *upstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.mu.Lock()
+	u.paths = append(u.paths, r.URL.RequestURI())
+	u.mu.Unlock()
+	io.WriteString(w, "upstream "+r.URL.Path)
+}
+
+func proxyHoard(t *testing.T, prefix string) (*HoardHandler, *upstream) {
+	dir, err := ioutil.TempDir("", "hoard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	if err := ioutil.WriteFile(filepath.Join(dir, "site.css"), []byte("a{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	hh, err := Create(prefix, http.Dir(dir), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	up := &upstream{}
+	srv := httptest.NewServer(up)
+	t.Cleanup(srv.Close)
+	if err := hh.DevProxy(srv.URL+"/base/", prefix+"src/**"); err != nil {
+		t.Fatal(err)
+	}
+	return hh, up
+}
+
+func TestDevProxyRejectsRelativeURL(t *testing.T) {
+	hh, err := Create("/proxy-url/", http.Dir(os.TempDir()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := hh.DevProxy("localhost:5173"); err == nil {
+		t.Error("upstream without a scheme and host was accepted")
+	}
+}
+
+func TestDevProxyFallback(t *testing.T) {
+	hh, up := proxyHoard(t, "/proxy-fallback/")
+
+	// Only development mode proxies
+	rec := httptest.NewRecorder()
+	hh.ServeHTTP(rec, httptest.NewRequest("GET", "/proxy-fallback/missing.js", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("missing file outside development mode: status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+
+	hh.Dev = true
+	tests := []struct {
+		path string
+		code int
+		body string
+	}{
+		{"/proxy-fallback/missing.js", http.StatusOK, "upstream /base/missing.js"},
+		{"/proxy-fallback/src/main.ts?v=1", http.StatusOK, "upstream /base/src/main.ts"},
+		{"/proxy-fallback/site.css", http.StatusOK, "a{}"},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		hh.ServeHTTP(rec, httptest.NewRequest("GET", tt.path, nil))
+		if rec.Code != tt.code || rec.Body.String() != tt.body {
+			t.Errorf("%s: got %d %q, want %d %q", tt.path, rec.Code, rec.Body.String(), tt.code, tt.body)
+		}
+	}
+
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	want := []string{"/base/missing.js", "/base/src/main.ts?v=1"}
+	if strings.Join(up.paths, " ") != strings.Join(want, " ") {
+		t.Errorf("upstream was asked for %q, want %q", up.paths, want)
+	}
+}
+
+func TestDevProxyNames(t *testing.T) {
+	hh, _ := proxyHoard(t, "/proxy-names/")
+	tpl := template.Must(template.New("page").Funcs(Funcs()).Parse(
+		`{{ hoard "/proxy-names/src/main.ts" }}|{{ hoard_script "/proxy-names/src/app.js" }}|` +
+			`{{ hoard_module "/proxy-names/src/entry.js" }}|{{ hoard_style "/proxy-names/site.css" }}`))
+
+	// Outside development mode the names are hoard files, which do not exist
+	if err := tpl.Execute(ioutil.Discard, nil); err == nil {
+		t.Error("proxied names resolved outside development mode")
+	}
+
+	hh.Dev = true
+	var out strings.Builder
+	if err := tpl.Execute(&out, nil); err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(out.String(), "|")
+	tests := []struct {
+		name string
+		got  string
+		want string
+	}{
+		{"hoard", parts[0], "/proxy-names/src/main.ts"},
+		{"hoard_script", parts[1], `<script type="text/javascript" src="/proxy-names/src/app.js"></script>`},
+		{"hoard_module", parts[2], `<script type="module" src="/proxy-names/src/entry.js"></script>`},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, tt.got, tt.want)
+		}
+	}
+	if !strings.Contains(parts[3], `href="/proxy-names/`) || strings.Contains(parts[3], "site.css") {
+		t.Errorf("hoard_style of a hoard file: got %q, want its hashed URL", parts[3])
+	}
+}
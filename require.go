@@ -0,0 +1,213 @@
+package hoard
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+//
+// A file a template asked for with hoard_require, and what must come before it
+//
+type requirement struct {
+	name string
+	deps []string
+}
+
+//
+// Remember that the page needs a file, after the files it depends on. Nothing is
+// emitted until hoard_head or hoard_footer.
+//
+func (st *renderState) require(name string, deps ...string) (string, error) {
+	if st == nil {
+		return "", errors.New("hoard_require needs the functions from FuncsContext.")
+	}
+
+	// Catch missing files while the template is still running
+	for _, in := range append([]string{name}, deps...) {
+		if as := preloadAs(in); as != "style" && as != "script" {
+			return "", fmt.Errorf("hoard_require cannot place %s, only CSS and JS files.", in)
+		}
+		if _, _, err := loadBuffer(in); err != nil {
+			return "", err
+		}
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.required = append(st.required, requirement{name: name, deps: deps})
+	return "", nil
+}
+
+//
+// Mark where the required files of one type go, they are only known once the
+// whole page has rendered. A true argument bundles consecutive files from the
+// same hoard.
+//
+func (st *renderState) placeholder(as string, args ...interface{}) (template.HTML, error) {
+	if st == nil {
+		return "", errors.New("hoard_head and hoard_footer need the functions from FuncsContext.")
+	}
+
+	bundle := false
+	for _, v := range args {
+		b, ok := v.(bool)
+		if !ok {
+			return "", fmt.Errorf("Unexpected argument %v, expected whether to bundle.", v)
+		}
+		bundle = b
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.token == "" {
+		buf := make([]byte, 8)
+		if _, err := rand.Read(buf); err != nil {
+			panic(err)
+		}
+		st.token = hex.EncodeToString(buf)
+	}
+	if st.bundle == nil {
+		st.bundle = map[string]bool{}
+	}
+	st.bundle[as] = st.bundle[as] || bundle
+	return template.HTML(placeholderMarker(as, st.token)), nil
+}
+
+func placeholderMarker(as, token string) string {
+	return "<!--hoard:" + as + ":" + token + "-->"
+}
+
+//
+// Every required file once, each after the files it depends on, otherwise in the
+// order they were first required
+//
+func (st *renderState) requiredOrder() []string {
+	deps := map[string][]string{}
+	names := []string{}
+	for _, r := range st.required {
+		if _, ok := deps[r.name]; !ok {
+			names = append(names, r.name)
+		}
+		deps[r.name] = append(deps[r.name], r.deps...)
+	}
+
+	// Marked before visiting, so a dependency cycle is cut rather than followed
+	order := []string{}
+	seen := map[string]bool{}
+	var visit func(name string)
+	visit = func(name string) {
+		if seen[name] {
+			return
+		}
+		seen[name] = true
+		for _, d := range deps[name] {
+			visit(d)
+		}
+		order = append(order, name)
+	}
+	for _, name := range names {
+		visit(name)
+	}
+	return order
+}
+
+//
+// Tags for the required files of one type
+//
+func (st *renderState) requiredTags(names []string, as string, bundle bool) (string, error) {
+	defer lockStash()()
+
+	tags := []string{}
+	run := []string{}
+	flush := func() error {
+		var tag template.HTML
+		var err error
+		switch {
+		case len(run) == 0:
+			return nil
+		case len(run) > 1:
+			tag, err = multiLoad(st, nil, run, st.nonceAttrs())
+		case as == "style":
+			tag, err = styleTag(st, run[0])
+		default:
+			tag, err = scriptTag(st, run[0])
+		}
+		if err != nil {
+			return err
+		}
+		tags = append(tags, string(tag))
+		run = run[:0]
+		return nil
+	}
+
+	for _, name := range names {
+		if preloadAs(name) != as {
+			continue
+		}
+		if !bundle || len(run) > 0 && hoardOf(run[0]) != hoardOf(name) {
+			if err := flush(); err != nil {
+				return "", err
+			}
+		}
+		run = append(run, name)
+	}
+	if err := flush(); err != nil {
+		return "", err
+	}
+	return strings.Join(tags, "\n"), nil
+}
+
+//
+// Replace the hoard_head and hoard_footer markers in a rendered page with the
+// tags for the files the page required
+//
+func (st *renderState) renderRequired(page []byte) ([]byte, error) {
+	st.mu.Lock()
+	token := st.token
+	order := st.requiredOrder()
+	bundle := map[string]bool{}
+	for as, b := range st.bundle {
+		bundle[as] = b
+	}
+	st.mu.Unlock()
+
+	if token == "" {
+		return page, nil
+	}
+	for _, as := range []string{"style", "script"} {
+		marker := []byte(placeholderMarker(as, token))
+		if !bytes.Contains(page, marker) {
+			continue
+		}
+		tags, err := st.requiredTags(order, as, bundle[as])
+		if err != nil {
+			return nil, err
+		}
+		page = bytes.Replace(page, marker, []byte(tags), -1)
+	}
+	return page, nil
+}
+
+//
+// Middleware filling in hoard_head and hoard_footer once the page has rendered.
+// Templates have to use the functions from FuncsContext with the request's
+// context. PreloadHints does this too, so only one of them is needed.
+//
+func RenderAssets(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, st := withState(r.Context())
+		br := &bufferedResponse{ResponseWriter: w}
+		next.ServeHTTP(br, r.WithContext(ctx))
+		if err := br.render(st); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		br.send()
+	})
+}
@@ -0,0 +1,70 @@
+package hoard
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRequiredOrder(t *testing.T) {
+	tests := []struct {
+		name     string
+		required []requirement
+		want     []string
+	}{
+		{"first come first served", []requirement{{name: "b"}, {name: "a"}}, []string{"b", "a"}},
+		{"once each", []requirement{{name: "a"}, {name: "b"}, {name: "a"}}, []string{"a", "b"}},
+		{"dependencies first", []requirement{{name: "app", deps: []string{"lib", "util"}}}, []string{"lib", "util", "app"}},
+		{"dependency required later", []requirement{{name: "app", deps: []string{"lib"}}, {name: "lib"}}, []string{"lib", "app"}},
+		{"dependency required earlier", []requirement{{name: "lib"}, {name: "app", deps: []string{"lib"}}}, []string{"lib", "app"}},
+		{"transitive", []requirement{{name: "app", deps: []string{"ui"}}, {name: "ui", deps: []string{"core"}}}, []string{"core", "ui", "app"}},
+		{"dependencies added up", []requirement{{name: "app", deps: []string{"a"}}, {name: "app", deps: []string{"b"}}}, []string{"a", "b", "app"}},
+		{"cycle", []requirement{{name: "a", deps: []string{"b"}}, {name: "b", deps: []string{"a"}}}, []string{"b", "a"}},
+		{"none", nil, []string{}},
+	}
+	for _, tt := range tests {
+		st := &renderState{required: tt.required}
+		if got := st.requiredOrder(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRenderRequired(t *testing.T) {
+	testHoard(t, "/render-required/", map[string]string{
+		"lib.js": "lib()",
+		"app.js": "app()",
+		"a.css":  "a{}",
+	})
+
+	st := &renderState{}
+	if _, err := st.require("/render-required/app.js", "/render-required/lib.js"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.require("/render-required/a.css"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.require("/render-required/missing.js"); err == nil {
+		t.Error("a missing file was required")
+	}
+	if _, err := st.require("/render-required/a.png"); err == nil {
+		t.Error("an image was required")
+	}
+
+	head, _ := st.placeholder("style")
+	footer, _ := st.placeholder("script")
+	page, err := st.renderRequired([]byte("<head>" + string(head) + "</head><body>" + string(footer) + "</body>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lib := strings.Index(string(page), nameToHash["/render-required/lib.js"])
+	app := strings.Index(string(page), nameToHash["/render-required/app.js"])
+	style := strings.Index(string(page), nameToHash["/render-required/a.css"])
+	if lib < 0 || app < lib || style < 0 || style > strings.Index(string(page), "</head>") {
+		t.Errorf("tags out of place in %s", page)
+	}
+	if strings.Contains(string(page), "<!--hoard:") {
+		t.Errorf("markers left in %s", page)
+	}
+}
@@ -0,0 +1,367 @@
+package hoard
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"unicode/utf8"
+)
+
+const (
+	vlqChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+
+	// How far ahead in the source to look for a token of the output
+	alignWindow = 16 << 10
+)
+
+//
+// A version 3 source map for a single file
+//
+type sourceMap struct {
+	Version        int      `json:"version"`
+	File           string   `json:"file,omitempty"`
+	Sources        []string `json:"sources"`
+	SourcesContent []string `json:"sourcesContent,omitempty"`
+	Names          []string `json:"names"`
+	Mappings       string   `json:"mappings"`
+}
+
+//
+// A version 3 index map, stitching the maps of bundle members together
+//
+type indexMap struct {
+	Version  int          `json:"version"`
+	File     string       `json:"file,omitempty"`
+	Sections []mapSection `json:"sections"`
+}
+
+type mapSection struct {
+	Offset mapOffset  `json:"offset"`
+	Map    *sourceMap `json:"map"`
+}
+
+type mapOffset struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+//
+// Encodes mapping segments, keeping track of the previous values they are relative to
+//
+type mappingWriter struct {
+	buf             bytes.Buffer
+	genLine, genCol int
+	src             int
+	srcLine, srcCol int
+	started         bool
+}
+
+func appendVLQ(b *bytes.Buffer, v int) {
+	u := v << 1
+	if v < 0 {
+		u = -v<<1 | 1
+	}
+	for {
+		digit := u & 31
+		u >>= 5
+		if u > 0 {
+			digit |= 32
+		}
+		b.WriteByte(vlqChars[digit])
+		if u == 0 {
+			return
+		}
+	}
+}
+
+//
+// Map a position in the output to one in the (only) source
+//
+func (mw *mappingWriter) add(genLine, genCol, srcLine, srcCol int) {
+	mw.addSource(genLine, genCol, 0, srcLine, srcCol)
+}
+
+//
+// Map a position in the output to one in the source with the given index
+//
+func (mw *mappingWriter) addSource(genLine, genCol, src, srcLine, srcCol int) {
+	for mw.genLine < genLine {
+		mw.buf.WriteByte(';')
+		mw.genLine++
+		mw.genCol = 0
+		mw.started = false
+	}
+	if mw.started {
+		mw.buf.WriteByte(',')
+	}
+	appendVLQ(&mw.buf, genCol-mw.genCol)
+	appendVLQ(&mw.buf, src-mw.src)
+	appendVLQ(&mw.buf, srcLine-mw.srcLine)
+	appendVLQ(&mw.buf, srcCol-mw.srcCol)
+
+	mw.genCol = genCol
+	mw.src = src
+	mw.srcLine = srcLine
+	mw.srcCol = srcCol
+	mw.started = true
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c == '$' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+//
+// Width of the character at the start of b in UTF-16 code units, which is what
+// source map columns count, along with its length in bytes
+//
+func columnWidth(b []byte) (int, int) {
+	if b[0] < utf8.RuneSelf {
+		return 1, 1
+	}
+	r, size := utf8.DecodeRune(b)
+	if r >= 0x10000 {
+		return 2, size
+	}
+	return 1, size
+}
+
+//
+// Line and column of every offset into a buffer, computed incrementally
+//
+type positioner struct {
+	buf       []byte
+	off       int
+	line, col int
+}
+
+func (p *positioner) advance(to int) (int, int) {
+	for p.off < to {
+		if p.buf[p.off] == '\n' {
+			p.line++
+			p.col = 0
+			p.off++
+			continue
+		}
+		w, size := columnWidth(p.buf[p.off:])
+		p.col += w
+		p.off += size
+	}
+	return p.line, p.col
+}
+
+//
+// Find the next whole-word occurrence of a token in the source
+//
+func findToken(src []byte, from int, tok []byte) int {
+	end := from + alignWindow
+	if end > len(src) {
+		end = len(src)
+	}
+	for from < end {
+		i := bytes.Index(src[from:end], tok)
+		if i < 0 {
+			return -1
+		}
+		i += from
+		j := i + len(tok)
+		if (i == 0 || !isWordByte(src[i-1])) && (j == len(src) || !isWordByte(src[j])) {
+			return i
+		}
+		from = i + 1
+	}
+	return -1
+}
+
+//
+// Build a map from processed output back to its source. The minifiers only drop
+// whitespace and comments and shorten some literals, so words of the output appear
+// in the source in the same order and can be lined up one after another.
+//
+func alignSourceMap(source string, src, gen []byte) *sourceMap {
+	mw := &mappingWriter{}
+	srcPos := &positioner{buf: src}
+	alignTokens(src, gen, func(genLine, genCol, off int) {
+		srcLine, srcCol := srcPos.advance(off)
+		mw.add(genLine, genCol, srcLine, srcCol)
+	})
+
+	return &sourceMap{
+		Version:        3,
+		Sources:        []string{source},
+		SourcesContent: []string{string(src)},
+		Names:          []string{},
+		Mappings:       mw.buf.String(),
+	}
+}
+
+//
+// Map minified bundle content straight back to the original files of its
+// members, which are searched as if they were one file
+//
+func alignBundleSourceMap(members []*FileBuffer, gen []byte) *sourceMap {
+	var src bytes.Buffer
+	starts := make([]int, len(members)+1)
+	sources := make([]string, len(members))
+	contents := make([]string, len(members))
+	for i, m := range members {
+		original := m.body
+		if m.sourceMap != nil && len(m.sourceMap.SourcesContent) > 0 {
+			original = []byte(m.sourceMap.SourcesContent[0])
+		}
+		starts[i] = src.Len()
+		src.Write(original)
+		src.WriteByte('\n')
+		sources[i] = m.parent.Prefix + m.name
+		contents[i] = string(original)
+	}
+	starts[len(members)] = src.Len()
+
+	mw := &mappingWriter{}
+	srcPos := &positioner{buf: src.Bytes()}
+	member, firstLine := 0, 0
+	alignTokens(src.Bytes(), gen, func(genLine, genCol, off int) {
+		// Tokens are found in order, so members are only ever moved past
+		for off >= starts[member+1] {
+			member++
+			firstLine, _ = srcPos.advance(starts[member])
+		}
+		srcLine, srcCol := srcPos.advance(off)
+		mw.addSource(genLine, genCol, member, srcLine-firstLine, srcCol)
+	})
+
+	return &sourceMap{
+		Version:        3,
+		Sources:        sources,
+		SourcesContent: contents,
+		Names:          []string{},
+		Mappings:       mw.buf.String(),
+	}
+}
+
+//
+// Find each word of the output in the source, in order, calling found with its
+// position in the output and its offset in the source
+//
+func alignTokens(src, gen []byte, found func(genLine, genCol, off int)) {
+	cursor := 0
+
+	line, col := 0, 0
+	for i := 0; i < len(gen); {
+		c := gen[i]
+		if c == '\n' {
+			line++
+			col = 0
+			i++
+			continue
+		}
+		if !isWordByte(c) {
+			w, size := columnWidth(gen[i:])
+			col += w
+			i += size
+			continue
+		}
+
+		j := i
+		for j < len(gen) && isWordByte(gen[j]) {
+			j++
+		}
+		if k := findToken(src, cursor, gen[i:j]); k >= 0 {
+			found(line, col, k)
+			cursor = k + (j - i)
+		}
+		col += j - i
+		i = j
+	}
+}
+
+//
+// Map every line of unprocessed content to itself
+//
+func identitySourceMap(source string, content []byte) *sourceMap {
+	mw := &mappingWriter{}
+	lines := bytes.Count(content, []byte("\n"))
+	for i := 0; i <= lines; i++ {
+		mw.add(i, 0, i, 0)
+	}
+
+	return &sourceMap{
+		Version:  3,
+		Sources:  []string{source},
+		Names:    []string{},
+		Mappings: mw.buf.String(),
+	}
+}
+
+//
+// Comment linking content of a media type to its source map, nil if it has no syntax for one
+//
+func sourceMapComment(mediatype, url string) []byte {
+	switch mediatype {
+	case "text/css":
+		return []byte("\n/*# sourceMappingURL=" + url + " */\n")
+	case "text/javascript", "application/javascript":
+		return []byte("\n//# sourceMappingURL=" + url + "\n")
+	}
+	return nil
+}
+
+//
+// Serialize a map and stash it under its hash, returns its URL
+//
+func (hh *HoardHandler) stashSourceMap(m interface{}) (string, error) {
+	buf, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+
+	hash := fmt.Sprintf("%x.map", md5.Sum(buf))
+	hh.Stashed[hash] = &FileBuffer{
+		parent: hh,
+		buf:    buf,
+		body:   buf,
+		isMap:  true,
+	}
+	return hh.Prefix + hash, nil
+}
+
+//
+// Attach a source map to a file buffer, linking it from the content unless
+// the hoard sends it in a header instead
+//
+func (fb *FileBuffer) setSourceMap(mediatype string, m interface{}) error {
+	url, err := fb.parent.stashSourceMap(m)
+	if err != nil {
+		return err
+	}
+
+	fb.mapURL = url
+	if sm, ok := m.(*sourceMap); ok {
+		fb.sourceMap = sm
+	}
+	if !fb.parent.SourceMapHeader {
+		fb.trailer = sourceMapComment(mediatype, url)
+	}
+	return nil
+}
+
+//
+// Build the index map of a bundle from its members, given the joined content and
+// where each member starts in it
+//
+func bundleSourceMap(hh *HoardHandler, members []*FileBuffer, body []byte, starts []int) *indexMap {
+	m := &indexMap{Version: 3, Sections: make([]mapSection, 0, len(members))}
+	pos := &positioner{buf: body}
+	for i, member := range members {
+		pos.advance(starts[i])
+		sm := member.sourceMap
+		if sm == nil {
+			sm = identitySourceMap(member.parent.Prefix+member.name, member.body)
+		}
+		m.Sections = append(m.Sections, mapSection{
+			Offset: mapOffset{Line: pos.line, Column: pos.col},
+			Map:    sm,
+		})
+	}
+	return m
+}
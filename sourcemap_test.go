@@ -0,0 +1,143 @@
+package hoard
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAppendVLQ(t *testing.T) {
+	tests := []struct {
+		v    int
+		want string
+	}{
+		{0, "A"},
+		{1, "C"},
+		{-1, "D"},
+		{15, "e"},
+		{-15, "f"},
+		{16, "gB"},
+		{-16, "hB"},
+		{123, "2H"},
+		{-123, "3H"},
+		{1 << 20, "ggggC"},
+	}
+	for _, tt := range tests {
+		var b bytes.Buffer
+		appendVLQ(&b, tt.v)
+		if b.String() != tt.want {
+			t.Errorf("appendVLQ(%d) = %s, want %s", tt.v, b.String(), tt.want)
+		}
+	}
+}
+
+func TestMappingWriter(t *testing.T) {
+	mw := &mappingWriter{}
+	mw.add(0, 0, 0, 0)
+	mw.add(0, 4, 0, 6)
+	mw.add(2, 1, 1, 0)
+	mw.addSource(2, 3, 1, 0, 0)
+	if got, want := mw.buf.String(), "AAAA,IAAM;;CACN,ECDA"; got != want {
+		t.Errorf("mappings %s, want %s", got, want)
+	}
+}
+
+func TestColumnWidth(t *testing.T) {
+	tests := []struct {
+		s           string
+		width, size int
+	}{
+		{"a", 1, 1},
+		{"é", 1, 2},
+		{"€", 1, 3},
+		{"\U0001F600", 2, 4},
+	}
+	for _, tt := range tests {
+		if width, size := columnWidth([]byte(tt.s)); width != tt.width || size != tt.size {
+			t.Errorf("columnWidth(%q) = %d, %d, want %d, %d", tt.s, width, size, tt.width, tt.size)
+		}
+	}
+}
+
+func TestAlignSourceMap(t *testing.T) {
+	tests := []struct {
+		name     string
+		src, gen string
+		want     string
+	}{
+		{"minified", "a {\n  color: red;\n}\n", "a{color:red}", "AAAA,EACE,MAAO"},
+		{"unchanged", "a{}", "a{}", "AAAA"},
+		{"lines kept", "x;\ny;\n", "x;\ny;", "AAAA;AACA"},
+		{"wide characters", "s = '\U0001F600' + b", "s='\U0001F600'+b", "AAAA,OAAW"},
+		{"word missing from the source", "a b", "a z b", "AAAA,IAAE"},
+	}
+	for _, tt := range tests {
+		m := alignSourceMap("/s/x", []byte(tt.src), []byte(tt.gen))
+		if m.Mappings != tt.want {
+			t.Errorf("%s: mappings %s, want %s", tt.name, m.Mappings, tt.want)
+		}
+		if !reflect.DeepEqual(m.Sources, []string{"/s/x"}) || !reflect.DeepEqual(m.SourcesContent, []string{tt.src}) {
+			t.Errorf("%s: sources %v %q", tt.name, m.Sources, m.SourcesContent)
+		}
+	}
+}
+
+func TestSourceMapOutput(t *testing.T) {
+	squash := TransformerFunc(func(tc *TransformContext, src []byte) ([]byte, error) {
+		return []byte(strings.NewReplacer("\n", "", " ", "").Replace(string(src))), nil
+	})
+	hh := testHoard(t, "/source-maps/", map[string]string{
+		"a.js": "var a = 1;\nvar b = 2;\n",
+		"b.js": "var c = 3;\n",
+	})
+	hh.SetTransformers("text/javascript", squash)
+	hh.SetTransformers("application/javascript", squash)
+	hh.SourceMaps = true
+
+	_, fb, err := loadBuffer("/source-maps/a.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "vara=1;varb=2;\n//# sourceMappingURL=" + fb.mapURL + "\n"; string(fb.buf) != want {
+		t.Errorf("content %q, want %q", fb.buf, want)
+	}
+	var m sourceMap
+	if err := json.Unmarshal(hh.Stashed[hh.RemovePrefix(fb.mapURL)].buf, &m); err != nil {
+		t.Fatal(err)
+	}
+	// Only the numbers are words found in the source, the squashed declarations are not
+	if m.Version != 3 || !reflect.DeepEqual(m.Sources, []string{"/source-maps/a.js"}) || m.Mappings != "KAAQ,OACA" {
+		t.Errorf("map %+v", m)
+	}
+
+	// Bundles stitch the maps of their members together
+	_, bundle, err := loadBundle(nil, []string{"/source-maps/a.js", "/source-maps/b.js"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var index indexMap
+	if err := json.Unmarshal(hh.Stashed[hh.RemovePrefix(bundle.mapURL)].buf, &index); err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Sections) != 2 || index.Sections[0].Offset != (mapOffset{0, 0}) || index.Sections[1].Offset.Line == 0 {
+		t.Errorf("bundle map sections %+v", index.Sections)
+	}
+	for i, name := range []string{"/source-maps/a.js", "/source-maps/b.js"} {
+		if i < len(index.Sections) && index.Sections[i].Map.Sources[0] != name {
+			t.Errorf("section %d maps %v, want %s", i, index.Sections[i].Map.Sources, name)
+		}
+	}
+
+	// The map can be linked from a header instead
+	hh.SourceMapHeader = true
+	writeTestFile(t, string(hh.Dir), "c.js", "var d = 4;\n")
+	_, fb, err = loadBuffer("/source-maps/c.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(fb.buf) != "vard=4;" || fb.mapURL == "" {
+		t.Errorf("content %q with map %q, want no comment", fb.buf, fb.mapURL)
+	}
+}
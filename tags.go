@@ -0,0 +1,183 @@
+package hoard
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"regexp"
+	"strings"
+)
+
+//
+// An attribute of a generated tag
+//
+type Attr struct {
+	Name  string
+	Value string
+	Bool  bool // Rendered without a value, like defer
+	Unset bool // Removes the attribute if a default set it
+}
+
+//
+// Attributes of a generated tag, in the order they are rendered
+//
+type Attrs []Attr
+
+var attrName = regexp.MustCompile(`^[a-zA-Z_:][-a-zA-Z0-9_:.]*$`)
+
+// Attributes hoard sets itself, templates may only remove them
+var ownAttrs = map[string]bool{"src": true, "href": true, "integrity": true}
+
+// Attributes holding a URL, the same ones html/template treats as such
+var urlAttrs = map[string]bool{
+	"action": true, "archive": true, "background": true, "cite": true, "classid": true, "codebase": true,
+	"data": true, "formaction": true, "href": true, "icon": true, "longdesc": true, "manifest": true,
+	"poster": true, "profile": true, "src": true, "usemap": true, "xmlns": true,
+}
+
+//
+// Build attributes from template arguments, either Attrs or pairs of a name and
+// a string or bool value. A true bool gives a boolean attribute, false unsets it.
+// Values are only HTML escaped, so event handlers, which would run template data
+// as script, and the attributes hoard sets itself can only be unset.
+//
+func attrsFrom(args ...interface{}) (Attrs, error) {
+	var attrs Attrs
+	for i := 0; i < len(args); i++ {
+		switch v := args[i].(type) {
+		case Attrs:
+			attrs = append(attrs, v...)
+			continue
+		case Attr:
+			attrs = append(attrs, v)
+			continue
+		case string:
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("Attribute %s has no value.", v)
+			}
+			a := Attr{Name: v}
+			switch value := args[i+1].(type) {
+			case bool:
+				a.Bool = value
+				a.Unset = !value
+			case string:
+				a.Value = value
+			case fmt.Stringer:
+				a.Value = value.String()
+			default:
+				a.Value = fmt.Sprint(value)
+			}
+			key := strings.ToLower(v)
+			if !a.Unset && (strings.HasPrefix(key, "on") || ownAttrs[key]) {
+				return nil, fmt.Errorf("Attribute %s cannot be set from a template.", v)
+			}
+			attrs = append(attrs, a)
+			i++
+		default:
+			return nil, fmt.Errorf("Unexpected attribute argument %v.", v)
+		}
+	}
+	return attrs, nil
+}
+
+//
+// Render the opening of a tag from layers of attributes, later layers override
+// earlier ones but an attribute keeps the position it was first given
+//
+func openTag(tag string, layers ...Attrs) (string, error) {
+	var merged Attrs
+	index := make(map[string]int)
+	for _, layer := range layers {
+		for _, a := range layer {
+			if !attrName.MatchString(a.Name) {
+				return "", fmt.Errorf("Invalid attribute name %q.", a.Name)
+			}
+			key := strings.ToLower(a.Name)
+			if i, ok := index[key]; ok {
+				merged[i] = a
+				continue
+			}
+			index[key] = len(merged)
+			merged = append(merged, a)
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("<" + tag)
+	for _, a := range merged {
+		switch {
+		case a.Unset:
+		case a.Bool:
+			buf.WriteString(" " + a.Name)
+		case urlAttrs[strings.ToLower(a.Name)]:
+			buf.WriteString(" " + a.Name + `="` + template.HTMLEscapeString(safeURL(a.Value)) + `"`)
+		default:
+			buf.WriteString(" " + a.Name + `="` + template.HTMLEscapeString(a.Value) + `"`)
+		}
+	}
+	return buf.String(), nil
+}
+
+//
+// Replace a URL with a harmless one unless it is relative or uses http, https or
+// mailto, the way html/template does, so it cannot run script when followed
+//
+func safeURL(url string) string {
+	if i := strings.IndexAny(url, ":/?#"); i >= 0 && url[i] == ':' {
+		switch strings.ToLower(url[:i]) {
+		case "http", "https", "mailto":
+		default:
+			return "#ZgotmplZ"
+		}
+	}
+	return url
+}
+
+//
+// Render an empty tag, void ones such as link have no closing tag
+//
+func renderTag(tag string, void bool, layers ...Attrs) (template.HTML, error) {
+	open, err := openTag(tag, layers...)
+	if err != nil {
+		return "", err
+	}
+	if void {
+		return template.HTML(open + " />"), nil
+	}
+	return template.HTML(open + "></" + tag + ">"), nil
+}
+
+//
+// Render a tag around content, which must already be safe to put inside it
+//
+func renderInline(tag, content string, layers ...Attrs) (template.HTML, error) {
+	open, err := openTag(tag, layers...)
+	if err != nil {
+		return "", err
+	}
+	return template.HTML(open + ">" + content + "</" + tag + ">"), nil
+}
+
+//
+// Escape content going inside a script or style element so nothing in it can end
+// the element early. A backslash before the slash or bang keeps the meaning the
+// same in both JS and CSS strings, where such sequences appear.
+//
+func escapeInline(content, tag string) string {
+	lower := strings.ToLower(content)
+	var buf bytes.Buffer
+	last := 0
+	for i := 0; i < len(lower); i++ {
+		if lower[i] != '<' {
+			continue
+		}
+		rest := lower[i+1:]
+		if strings.HasPrefix(rest, "/"+tag) || strings.HasPrefix(rest, "!--") {
+			buf.WriteString(content[last : i+1])
+			buf.WriteString("\\")
+			last = i + 1
+		}
+	}
+	buf.WriteString(content[last:])
+	return buf.String()
+}
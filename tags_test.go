@@ -0,0 +1,142 @@
+package hoard
+
+import (
+	"testing"
+)
+
+func TestAttrsFrom(t *testing.T) {
+	tests := []struct {
+		name string
+		args []interface{}
+		want Attrs // Nil if it has to fail
+	}{
+		{"value", []interface{}{"id", "x"}, Attrs{{Name: "id", Value: "x"}}},
+		{"boolean", []interface{}{"defer", true}, Attrs{{Name: "defer", Bool: true}}},
+		{"unset", []interface{}{"crossorigin", false}, Attrs{{Name: "crossorigin", Unset: true}}},
+		{"other value", []interface{}{"tabindex", 2}, Attrs{{Name: "tabindex", Value: "2"}}},
+		{"attrs", []interface{}{Attrs{{Name: "a", Value: "1"}}, "b", "2"}, Attrs{{Name: "a", Value: "1"}, {Name: "b", Value: "2"}}},
+		{"unset integrity", []interface{}{"integrity", false}, Attrs{{Name: "integrity", Unset: true}}},
+		{"unset handler", []interface{}{"onload", false}, Attrs{{Name: "onload", Unset: true}}},
+		{"event handler", []interface{}{"onload", "alert(1)"}, nil},
+		{"upper case handler", []interface{}{"OnError", "alert(1)"}, nil},
+		{"src", []interface{}{"src", "/x.js"}, nil},
+		{"href", []interface{}{"HREF", "/x.css"}, nil},
+		{"integrity", []interface{}{"integrity", "sha384-x"}, nil},
+		{"missing value", []interface{}{"id"}, nil},
+		{"not a name", []interface{}{1, "x"}, nil},
+	}
+	for _, tt := range tests {
+		got, err := attrsFrom(tt.args...)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%s: got %v, want an error", tt.name, got)
+			}
+			continue
+		}
+		if err != nil || len(got) != len(tt.want) {
+			t.Errorf("%s: got %v %v, want %v", tt.name, got, err, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestOpenTag(t *testing.T) {
+	base := Attrs{{Name: "type", Value: "text/javascript"}, {Name: "src", Value: "/s/a.js"}}
+	tests := []struct {
+		name   string
+		layers []Attrs
+		want   string
+	}{
+		{"base", []Attrs{base}, `<script type="text/javascript" src="/s/a.js"`},
+		{"override keeps position", []Attrs{base, {{Name: "TYPE", Value: "module"}}}, `<script TYPE="module" src="/s/a.js"`},
+		{"unset", []Attrs{base, {{Name: "type", Unset: true}}}, `<script src="/s/a.js"`},
+		{"boolean", []Attrs{base, {{Name: "defer", Bool: true}}}, `<script type="text/javascript" src="/s/a.js" defer`},
+		{"escaped", []Attrs{{{Name: "title", Value: `"><script>&`}}}, `<script title="&#34;&gt;&lt;script&gt;&amp;"`},
+		{"https URL", []Attrs{{{Name: "src", Value: "https://cdn.example/a.js"}}}, `<script src="https://cdn.example/a.js"`},
+		{"javascript URL", []Attrs{{{Name: "src", Value: "javascript:alert(1)"}}}, `<script src="#ZgotmplZ"`},
+		{"spaced scheme", []Attrs{{{Name: "href", Value: " JavaScript:alert(1)"}}}, `<script href="#ZgotmplZ"`},
+		{"data URL", []Attrs{{{Name: "src", Value: "data:text/javascript,alert(1)"}}}, `<script src="#ZgotmplZ"`},
+		{"colon after path", []Attrs{{{Name: "src", Value: "/s/a:b.js"}}}, `<script src="/s/a:b.js"`},
+		{"not a URL attribute", []Attrs{{{Name: "title", Value: "javascript:"}}}, `<script title="javascript:"`},
+	}
+	for _, tt := range tests {
+		got, err := openTag("script", tt.layers...)
+		if err != nil || got != tt.want {
+			t.Errorf("%s: got %s %v, want %s", tt.name, got, err, tt.want)
+		}
+	}
+
+	if _, err := openTag("script", Attrs{{Name: `x"onload`, Value: "1"}}); err == nil {
+		t.Error("invalid attribute name was accepted")
+	}
+}
+
+func TestTagAttributesFromTemplates(t *testing.T) {
+	testHoard(t, "/tag-attrs/", map[string]string{"a.js": "a()"})
+
+	if _, err := scriptTag(nil, "/tag-attrs/a.js", "onload", "alert(1)"); err == nil {
+		t.Error("hoard_script accepted an event handler")
+	}
+	if _, err := scriptTag(nil, "/tag-attrs/a.js", "src", "javascript:alert(1)"); err == nil {
+		t.Error("hoard_script accepted a src")
+	}
+	tag, err := scriptTag(nil, "/tag-attrs/a.js", "integrity", false, "crossorigin", false, "async", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `<script type="text/javascript" src="` + nameToHash["/tag-attrs/a.js"] + `" async></script>`
+	if string(tag) != want {
+		t.Errorf("got %s, want %s", tag, want)
+	}
+}
+
+func TestEscapeInline(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		tag     string
+		want    string
+	}{
+		{"plain", "a{}", "style", "a{}"},
+		{"closing tag", `s = "</script>"`, "script", `s = "<\/script>"`},
+		{"upper case", `s = "</SCRIPT >"`, "script", `s = "<\/SCRIPT >"`},
+		{"comment", `s = "<!-- x"`, "script", `s = "<\!-- x"`},
+		{"other closing tag", `s = "</style>"`, "script", `s = "</style>"`},
+		{"style", `a{content:"</style>"}`, "style", `a{content:"<\/style>"}`},
+		{"several", "</script></script>", "script", `<\/script><\/script>`},
+		{"less than", "a < b && c </ d", "script", "a < b && c </ d"},
+		{"at the end", "x<", "script", "x<"},
+	}
+	for _, tt := range tests {
+		if got := escapeInline(tt.content, tt.tag); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestInlineTags(t *testing.T) {
+	testHoard(t, "/inline-tags/", map[string]string{
+		"a.js":  `document.write("</script><script>alert(1)")`,
+		"a.css": `a::after{content:"</style>"}`,
+	})
+
+	script, err := inlineScript(nil, "/inline-tags/a.js", "id", "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `<script type="text/javascript" id="x">document.write("<\/script><script>alert(1)")</script>`; string(script) != want {
+		t.Errorf("got %s, want %s", script, want)
+	}
+	style, err := inlineStyle(nil, "/inline-tags/a.css")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `<style>a::after{content:"<\/style>"}</style>`; string(style) != want {
+		t.Errorf("got %s, want %s", style, want)
+	}
+}
@@ -2,35 +2,315 @@ package hoard
 
 import (
 	"fmt"
+	"sync"
+	"errors"
+	"strings"
+	"encoding/json"
 	"html/template"
 )
 
 
 var (
-	tMap = template.FuncMap{
-		"hoard": singleResource,
-		"hoard_bundle": blockResources,
-	}
-	nameToHash = map[string]string{}
+	tMap = funcMap(nil)
+	nameToHash = map[string]string{} // Hashed URL of every file, by its name under its hoard's prefix
 	hoards = map[string]*HoardHandler{}
 
-	cssFmt = `<link rel="stylesheet" type="text/css" media="screen" href="%s" />`
-	jsFmt = `<script type="text/javascript" src="%s"></script>`
+	// Guards the state of every hoard, taken wherever a request or the dev watcher comes in
+	stashLock sync.Mutex
 )
 
 
+func lockStash() func() {
+	stashLock.Lock()
+	return stashLock.Unlock
+}
+
+
 func addHoard(hh *HoardHandler) {
 	hoards[hh.Prefix] = hh
 }
 
-func singleResource(in string) string {
-	// Find matching hoard
-	return preload(in)
+func hoardOf(name string) *HoardHandler {
+	// Find the hoard a file belongs to, the longest prefix wins, nil if there is none
+	var found *HoardHandler
+	for key, hh := range hoards {
+		if strings.HasPrefix(name, key) && (found == nil || len(key) > len(found.Prefix)) {
+			found = hh
+		}
+	}
+	return found
+}
+
+func funcMap(st *renderState) template.FuncMap {
+	// Functions emitting tags get the state of the render they are part of, and
+	// all of them hold the stash while they work
+	return template.FuncMap{
+		"hoard": func(in string) (string, error) {
+			defer lockStash()()
+			return singleResource(st, in)
+		},
+		"hoard_bundle": func(in ...interface{}) (template.HTML, error) {
+			defer lockStash()()
+			return blockResources(st, in...)
+		},
+		"hoard_importmap": func(pairs ...string) (template.HTML, error) {
+			defer lockStash()()
+			return importMap(st, pairs...)
+		},
+		"hoard_module": func(in string, args ...interface{}) (template.HTML, error) {
+			defer lockStash()()
+			return moduleResource(st, in, args...)
+		},
+		"hoard_script": func(in string, args ...interface{}) (template.HTML, error) {
+			defer lockStash()()
+			return scriptTag(st, in, args...)
+		},
+		"hoard_style": func(in string, args ...interface{}) (template.HTML, error) {
+			defer lockStash()()
+			return styleTag(st, in, args...)
+		},
+		"hoard_inline_js": func(in string, args ...interface{}) (template.HTML, error) {
+			defer lockStash()()
+			return inlineScript(st, in, args...)
+		},
+		"hoard_inline_css": func(in string, args ...interface{}) (template.HTML, error) {
+			defer lockStash()()
+			return inlineStyle(st, in, args...)
+		},
+		"hoard_require": func(in string, deps ...string) (string, error) {
+			defer lockStash()()
+			return st.require(in, deps...)
+		},
+		"hoard_head": func(args ...interface{}) (template.HTML, error) {
+			return st.placeholder("style", args...)
+		},
+		"hoard_footer": func(args ...interface{}) (template.HTML, error) {
+			return st.placeholder("script", args...)
+		},
+		"hoard_livereload": func() (template.HTML, error) {
+			defer lockStash()()
+			return liveReload(st)
+		},
+		"hoard_data_uri": func(in string) (template.URL, error) {
+			defer lockStash()()
+			return dataURI(in)
+		},
+		"hoard_integrity": func(in string) (string, error) {
+			defer lockStash()()
+			return integrityValue(in)
+		},
+		"hoard_attrs": attrsFrom,
+	}
+}
+
+func singleResource(st *renderState, in string) (string, error) {
+	// The development server has its own URLs for what it serves
+	if _, ok := proxied(in); ok {
+		return in, nil
+	}
+
+	// Files outside of every hoard are left as they are
+	if hoardOf(in) == nil {
+		return in, nil
+	}
+	url, fb, err := loadBuffer(in)
+	if err != nil {
+		return "", err
+	}
+	st.collect(url, fb, false)
+	return url, nil
 }
 
-func blockResources(in ...string) (template.HTML, error) {
+func blockResources(st *renderState, in ...interface{}) (template.HTML, error) {
+	// Split filenames from attributes for the tag
+	names := make([]string, 0, len(in))
+	attrs := st.nonceAttrs()
+	for _, v := range in {
+		switch v := v.(type) {
+		case string:
+			names = append(names, v)
+		case Attrs:
+			attrs = append(attrs, v...)
+		default:
+			return "", fmt.Errorf("Unexpected hoard_bundle argument %v.", v)
+		}
+	}
+
+	// A single name refers to a bundle declared in Go, served by the hoard declaring it
+	var owner *HoardHandler
+	if len(names) == 1 {
+		if hh, members, ok := namedBundle(names[0]); ok {
+			owner, names = hh, members
+		}
+	}
+
 	// Load a block of resources into a single file
-	return multiLoad(in)
+	return multiLoad(st, owner, names, attrs)
+}
+
+func moduleResource(st *renderState, in string, args ...interface{}) (template.HTML, error) {
+	attrs, err := attrsFrom(args...)
+	if err != nil {
+		return "", err
+	}
+	attrs = append(st.nonceAttrs(), attrs...)
+	if hh, ok := proxied(in); ok {
+		return wrapModule(hh, in, "", attrs)
+	}
+
+	// Bundle a module and its imports into a single file
+	hh := hoardOf(in)
+	if hh == nil {
+		return "", errors.New("hoard_module tag with a file outside of any hoard.")
+	}
+	url, err := hh.bundleModule(hh.RemovePrefix(in))
+	if err != nil {
+		return "", err
+	}
+	st.collect(url, nil, true)
+	return wrapModule(hh, url, hh.modules[hh.RemovePrefix(in)].fb.integrity, attrs)
+}
+
+func loadBuffer(in string) (string, *FileBuffer, error) {
+	// Load a single file and get the buffer holding it
+	hh := hoardOf(in)
+	if hh == nil {
+		return "", nil, fmt.Errorf("%s is not in any hoard.", in)
+	}
+	url, err := addResource(hh.RemovePrefix(in), hh)
+	if err != nil {
+		return "", nil, err
+	}
+	return url, hh.Stashed[hh.RemovePrefix(in)], nil
+}
+
+func scriptTag(st *renderState, in string, args ...interface{}) (template.HTML, error) {
+	attrs, err := attrsFrom(args...)
+	if err != nil {
+		return "", err
+	}
+	attrs = append(st.nonceAttrs(), attrs...)
+	if hh, ok := proxied(in); ok {
+		return wrapJS(hh, in, "", attrs)
+	}
+
+	// Script tag for a single file
+	url, fb, err := loadBuffer(in)
+	if err != nil {
+		return "", err
+	}
+	st.collect(url, fb, false)
+	return wrapJS(fb.parent, url, fb.integrity, attrs)
+}
+
+func styleTag(st *renderState, in string, args ...interface{}) (template.HTML, error) {
+	attrs, err := attrsFrom(args...)
+	if err != nil {
+		return "", err
+	}
+	attrs = append(st.nonceAttrs(), attrs...)
+	if hh, ok := proxied(in); ok {
+		return wrapCSS(hh, in, "", attrs)
+	}
+
+	// Stylesheet link for a single file
+	url, fb, err := loadBuffer(in)
+	if err != nil {
+		return "", err
+	}
+	st.collect(url, fb, false)
+	return wrapCSS(fb.parent, url, fb.integrity, attrs)
+}
+
+func inlineScript(st *renderState, in string, args ...interface{}) (template.HTML, error) {
+	attrs, err := attrsFrom(args...)
+	if err != nil {
+		return "", err
+	}
+
+	// Contents of a single file in a script tag
+	_, fb, err := loadBuffer(in)
+	if err != nil {
+		return "", err
+	}
+	content := escapeInline(string(fb.body), "script")
+	st.recordInline(true, in, content)
+	return renderInline("script", content, Attrs{{Name: "type", Value: "text/javascript"}}, st.nonceAttrs(), attrs)
+}
+
+func inlineStyle(st *renderState, in string, args ...interface{}) (template.HTML, error) {
+	attrs, err := attrsFrom(args...)
+	if err != nil {
+		return "", err
+	}
+
+	// Contents of a single file in a style tag
+	_, fb, err := loadBuffer(in)
+	if err != nil {
+		return "", err
+	}
+	content := escapeInline(string(fb.body), "style")
+	st.recordInline(false, in, content)
+	return renderInline("style", content, st.nonceAttrs(), attrs)
+}
+
+func dataURI(in string) (template.URL, error) {
+	// Contents of a single file as a data URI
+	_, fb, err := loadBuffer(in)
+	if err != nil {
+		return "", err
+	}
+	return template.URL(fb.dataURI()), nil
+}
+
+func integrityValue(in string) (string, error) {
+	// Bare integrity value of a single file
+	_, fb, err := loadBuffer(in)
+	if err != nil {
+		return "", err
+	}
+	return fb.integrity, nil
+}
+
+func importMap(st *renderState, pairs ...string) (template.HTML, error) {
+	// Map bare specifiers to the hashed URL of their module
+	if len(pairs)%2 != 0 {
+		return "", errors.New("hoard_importmap takes pairs of specifiers and filenames.")
+	}
+
+	targets := map[string]string{}
+	for _, hh := range hoards {
+		for spec, name := range hh.Imports {
+			targets[spec] = name
+		}
+	}
+	for i := 0; i < len(pairs); i += 2 {
+		targets[pairs[i]] = pairs[i+1]
+	}
+
+	imports := map[string]string{}
+	for spec, name := range targets {
+		// Directory mappings cannot be hashed as a whole
+		if strings.HasSuffix(name, "/") {
+			imports[spec] = name
+			continue
+		}
+
+		hashed, err := preload(name)
+		if err != nil {
+			return "", err
+		}
+		imports[spec] = hashed
+	}
+
+	// The encoder escapes <, > and & so the map cannot end the script early
+	buf, err := json.Marshal(map[string]interface{}{"imports": imports})
+	if err != nil {
+		return "", err
+	}
+	st.recordInline(true, "hoard_importmap "+strings.Join(pairs, " "), string(buf))
+
+	return renderInline("script", string(buf), Attrs{{Name: "type", Value: "importmap"}}, st.nonceAttrs())
 }
 
 func Funcs() template.FuncMap {
@@ -38,10 +318,18 @@ func Funcs() template.FuncMap {
 }
 
 
-func wrapCSS(filename string) template.HTML {
-	return template.HTML(fmt.Sprintf(cssFmt, filename))
+func wrapCSS(hh *HoardHandler, filename, integrity string, attrs Attrs) (template.HTML, error) {
+	base := Attrs{{Name: "rel", Value: "stylesheet"}, {Name: "type", Value: "text/css"}, {Name: "media", Value: "screen"}, {Name: "href", Value: filename}}
+	return renderTag("link", true, base, hh.StyleAttrs, integrityAttrs(integrity), attrs)
+}
+
+func wrapJS(hh *HoardHandler, filename, integrity string, attrs Attrs) (template.HTML, error) {
+	base := Attrs{{Name: "type", Value: "text/javascript"}, {Name: "src", Value: filename}}
+	return renderTag("script", false, base, hh.ScriptAttrs, integrityAttrs(integrity), attrs)
 }
 
-func wrapJS(filename string) template.HTML {
-	return template.HTML(fmt.Sprintf(jsFmt, filename))
+func wrapModule(hh *HoardHandler, filename, integrity string, attrs Attrs) (template.HTML, error) {
+	base := Attrs{{Name: "type", Value: "module"}, {Name: "src", Value: filename}}
+	module := Attrs{{Name: "type", Value: "module"}}
+	return renderTag("script", false, base, hh.ScriptAttrs, module, integrityAttrs(integrity), attrs)
 }
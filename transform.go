@@ -0,0 +1,219 @@
+package hoard
+
+import (
+	"fmt"
+	"log"
+	"mime"
+	"strings"
+	"sync/atomic"
+)
+
+//
+// A single processing step applied to a file's content before it is stashed
+//
+type Transformer interface {
+	Transform(tc *TransformContext, src []byte) ([]byte, error)
+}
+
+//
+// Adapter so ordinary functions can be used as transformers
+//
+type TransformerFunc func(tc *TransformContext, src []byte) ([]byte, error)
+
+func (f TransformerFunc) Transform(tc *TransformContext, src []byte) ([]byte, error) {
+	return f(tc, src)
+}
+
+//
+// What a transformer knows about the file it is working on
+//
+type TransformContext struct {
+	Hoard     *HoardHandler // Hoard the file belongs to
+	Name      string        // Name of the file relative to the hoard directory
+	MediaType string        // Media type without parameters, e.g. text/css
+
+	deps  []string          // Extra files the output depends on
+	links map[string]string // URL each file linked from the output had, by its name under its hoard's prefix
+}
+
+//
+// Declare another file in the hoard as an input, so editing it invalidates this one
+//
+func (tc *TransformContext) AddDependency(name string) {
+	for _, d := range tc.deps {
+		if d == name {
+			return
+		}
+	}
+	tc.deps = append(tc.deps, name)
+}
+
+//
+// Remember the URL the output links a file by, so the output is rebuilt once
+// that URL changes, even when it changed because of a file further down
+//
+func (tc *TransformContext) addLink(name, url string) {
+	if tc.links == nil {
+		tc.links = make(map[string]string)
+	}
+	tc.links[name] = url
+}
+
+//
+// Error from a transformer, identifying the stage and file that failed
+//
+type TransformError struct {
+	Name  string
+	Stage int
+	Err   error
+}
+
+func (e *TransformError) Error() string {
+	return fmt.Sprintf("hoard: transforming %s (stage %d): %v", e.Name, e.Stage, e.Err)
+}
+
+//
+// The built in minify step, using the hoard's minifier
+//
+var Minifier Transformer = minifier{}
+
+type minifier struct{}
+
+func (minifier) Transform(tc *TransformContext, src []byte) ([]byte, error) {
+	return tc.Hoard.minify(tc.MediaType, src)
+}
+
+//
+// Strip parameters such as charset from a content type
+//
+func mediaType(ctype string) string {
+	if mt, _, err := mime.ParseMediaType(ctype); err == nil {
+		return mt
+	}
+	if i := strings.Index(ctype, ";"); i >= 0 {
+		ctype = ctype[:i]
+	}
+	return strings.TrimSpace(strings.ToLower(ctype))
+}
+
+//
+// Append a transformer to the end of the pipeline for a media type
+//
+func (hh *HoardHandler) AddTransformer(mediatype string, t Transformer) {
+	hh.Transformers[mediatype] = append(hh.Transformers[mediatype], t)
+}
+
+//
+// Replace the whole pipeline for a media type, an empty list removes it
+//
+func (hh *HoardHandler) SetTransformers(mediatype string, ts ...Transformer) {
+	if len(ts) == 0 {
+		delete(hh.Transformers, mediatype)
+		return
+	}
+	hh.Transformers[mediatype] = ts
+}
+
+//
+// Find the pipeline for a content type, the longest matching prefix wins
+//
+func (hh *HoardHandler) pipeline(ctype string) []Transformer {
+	best := ""
+	var ts []Transformer
+	for t, p := range hh.Transformers {
+		if strings.HasPrefix(ctype, t) && len(t) > len(best) {
+			best = t
+			ts = p
+		}
+	}
+	return ts
+}
+
+//
+// Counters describing how file processing has gone so far
+//
+type Stats struct {
+	Processed int64 // Files run through their pipeline
+	Failures  int64 // Stages that returned an error
+	Fallbacks int64 // Files stashed with a failed stage skipped
+}
+
+//
+// Get a snapshot of the processing counters
+//
+func (hh *HoardHandler) Stats() Stats {
+	return Stats{
+		Processed: atomic.LoadInt64(&hh.stats.Processed),
+		Failures:  atomic.LoadInt64(&hh.stats.Failures),
+		Fallbacks: atomic.LoadInt64(&hh.stats.Fallbacks),
+	}
+}
+
+//
+// Pass an error to the error callback, or log it if there is none. Development
+// mode also keeps it to show on pages.
+//
+func (hh *HoardHandler) reportError(name string, err error) {
+	if hh.OnError != nil {
+		hh.OnError(name, err)
+	} else {
+		log.Println(err)
+	}
+	hh.keepError(name, err)
+}
+
+//
+// Check if content of a media type gets minified
+//
+func (hh *HoardHandler) minifies(mediatype string) bool {
+	for _, t := range hh.pipeline(mediatype) {
+		if t == Minifier {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// Run content through every stage of the pipeline for its type. A failing
+// stage is skipped, passing its input on to the next one, unless the hoard
+// is strict in which case the error is returned.
+//
+func (hh *HoardHandler) transform(name, ctype string, src []byte) ([]byte, *TransformContext, error) {
+	return hh.runStages(name, ctype, src, hh.pipeline(ctype))
+}
+
+//
+// Run content through the given stages, as transform does with the whole pipeline
+//
+func (hh *HoardHandler) runStages(name, ctype string, src []byte, stages []Transformer) ([]byte, *TransformContext, error) {
+	tc := &TransformContext{
+		Hoard:     hh,
+		Name:      name,
+		MediaType: mediaType(ctype),
+	}
+
+	atomic.AddInt64(&hh.stats.Processed, 1)
+
+	buf := src
+	failed := false
+	for i, t := range stages {
+		out, err := t.Transform(tc, buf)
+		if err != nil {
+			err = &TransformError{Name: name, Stage: i, Err: err}
+			atomic.AddInt64(&hh.stats.Failures, 1)
+			hh.reportError(name, err)
+			if hh.Strict {
+				return nil, tc, err
+			}
+			failed = true
+			continue
+		}
+		buf = out
+	}
+
+	if failed {
+		atomic.AddInt64(&hh.stats.Fallbacks, 1)
+	}
+	return buf, tc, nil
+}
@@ -0,0 +1,77 @@
+package hoard
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestMediaType(t *testing.T) {
+	tests := []struct {
+		ctype string
+		want  string
+	}{
+		{"text/css", "text/css"},
+		{"text/css; charset=utf-8", "text/css"},
+		{"Text/JavaScript ; charset=utf-8", "text/javascript"},
+		{"text/css; broken=", "text/css"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := mediaType(tt.ctype); got != tt.want {
+			t.Errorf("mediaType(%q) = %q, want %q", tt.ctype, got, tt.want)
+		}
+	}
+}
+
+func TestTransformFallback(t *testing.T) {
+	fail := TransformerFunc(func(tc *TransformContext, src []byte) ([]byte, error) {
+		return nil, errors.New("broken")
+	})
+	upper := TransformerFunc(func(tc *TransformContext, src []byte) ([]byte, error) {
+		return []byte(strings.ToUpper(string(src))), nil
+	})
+
+	tests := []struct {
+		name   string
+		stages []Transformer
+		strict bool
+		want   string // Empty if it has to fail
+		stats  Stats
+	}{
+		{"no stages", nil, false, "a b", Stats{Processed: 1}},
+		{"working stage", []Transformer{upper}, false, "A B", Stats{Processed: 1}},
+		{"failing stage is skipped", []Transformer{fail, upper}, false, "A B", Stats{Processed: 1, Failures: 1, Fallbacks: 1}},
+		{"every stage failing", []Transformer{fail, fail}, false, "a b", Stats{Processed: 1, Failures: 2, Fallbacks: 1}},
+		{"strict", []Transformer{upper, fail}, true, "", Stats{Processed: 1, Failures: 1}},
+	}
+	for i, tt := range tests {
+		var reported []string
+		hh := testHoard(t, "/transform-fallback/"+string(rune('a'+i))+"/", map[string]string{"x.txt": "a b"})
+		hh.SetTransformers("text/plain", tt.stages...)
+		hh.Strict = tt.strict
+		hh.OnError = func(name string, err error) {
+			reported = append(reported, err.Error())
+		}
+
+		_, err := addResource("x.txt", hh)
+		if tt.want == "" {
+			var te *TransformError
+			if !errors.As(err, &te) || te.Name != "x.txt" || te.Stage != 1 {
+				t.Errorf("%s: got error %v, want one from stage 1 of x.txt", tt.name, err)
+			}
+			if _, ok := hh.Stashed["x.txt"]; ok {
+				t.Errorf("%s: failed file was stashed", tt.name)
+			}
+		} else if err != nil || string(hh.Stashed["x.txt"].buf) != tt.want {
+			t.Errorf("%s: got %v, want %q", tt.name, err, tt.want)
+		}
+
+		if got := hh.Stats(); got != tt.stats {
+			t.Errorf("%s: stats %+v, want %+v", tt.name, got, tt.stats)
+		}
+		if int64(len(reported)) != tt.stats.Failures {
+			t.Errorf("%s: reported %q", tt.name, reported)
+		}
+	}
+}